@@ -0,0 +1,231 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/pipeline"
+	"github.com/dvirsky/timedis/query/ast"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluator(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+	rule := Rule{ID: "r1", Name: "cpu", Condition: Condition{Op: ">", Threshold: 10, For: 5, NoData: 30}}
+	e := newEvaluator(rule, Status{}, start)
+	assert.Equal(t, StateInactive, e.status.State)
+
+	at := func(sec int64) time.Time { return time.Unix(1000+sec, 0) }
+	observe := func(sec int64, v float64) (Transition, bool) {
+		return e.observe(events.NewEvent("cpu", at(sec), v), at(sec))
+	}
+
+	_, changed := observe(0, 5)
+	assert.False(t, changed)
+
+	tr, changed := observe(1, 20)
+	assert.True(t, changed)
+	assert.Equal(t, StateInactive, tr.From)
+	assert.Equal(t, StatePending, tr.To)
+
+	// the condition has to hold for 5 seconds
+	_, changed = observe(3, 20)
+	assert.False(t, changed)
+	tr, changed = observe(6, 20)
+	assert.True(t, changed)
+	assert.Equal(t, StateFiring, tr.To)
+	assert.Equal(t, ReasonThreshold, tr.Reason)
+	assert.Equal(t, float64(20), tr.Value)
+
+	tr, changed = observe(7, 1)
+	assert.True(t, changed)
+	assert.Equal(t, StateResolved, tr.To)
+
+	// a pending alert that recovers goes back to inactive
+	_, changed = observe(8, 20)
+	assert.True(t, changed)
+	tr, changed = observe(9, 1)
+	assert.True(t, changed)
+	assert.Equal(t, StateInactive, tr.To)
+
+	// no data fires
+	_, changed = e.tick(at(20))
+	assert.False(t, changed)
+	tr, changed = e.tick(at(40))
+	assert.True(t, changed)
+	assert.Equal(t, StateFiring, tr.To)
+	assert.Equal(t, ReasonNoData, tr.Reason)
+
+	// silenced transitions are marked as such
+	e.rule.SilencedUntil = at(100).Unix()
+	tr, changed = observe(50, 1)
+	assert.True(t, changed)
+	assert.Equal(t, StateResolved, tr.To)
+	assert.True(t, tr.Silenced)
+
+	assert.Error(t, Condition{Op: "~"}.Validate())
+	assert.Error(t, Condition{Op: ">", For: -1}.Validate())
+	assert.NoError(t, Condition{Op: "<="}.Validate())
+}
+
+type mockDocuments struct {
+	lock sync.Mutex
+	docs map[string]map[string][]byte
+	logs map[string][][]byte
+}
+
+func newMockDocuments() *mockDocuments {
+	return &mockDocuments{
+		docs: make(map[string]map[string][]byte),
+		logs: make(map[string][][]byte),
+	}
+}
+
+func (m *mockDocuments) SaveDocument(collection, id string, doc []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.docs[collection] == nil {
+		m.docs[collection] = make(map[string][]byte)
+	}
+	m.docs[collection][id] = doc
+	return nil
+}
+
+func (m *mockDocuments) LoadDocuments(collection string) (map[string][]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string][]byte)
+	for id, doc := range m.docs[collection] {
+		ret[id] = doc
+	}
+	return ret, nil
+}
+
+func (m *mockDocuments) DeleteDocument(collection, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.docs[collection], id)
+	return nil
+}
+
+func (m *mockDocuments) AppendLog(log string, entry []byte, maxLen int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.logs[log] = append([][]byte{entry}, m.logs[log]...)
+	if len(m.logs[log]) > maxLen {
+		m.logs[log] = m.logs[log][:maxLen]
+	}
+	return nil
+}
+
+func (m *mockDocuments) ReadLog(log string, n int) ([][]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entries := m.logs[log]
+	if n < len(entries) {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
+
+// mockStore streams whatever is pushed to updates to every subscriber
+type mockStore struct {
+	updates chan events.Result
+}
+
+func (m *mockStore) Put(evs ...*events.Event) error {
+	return nil
+}
+
+func (m *mockStore) Get(key string, from, to time.Time) (events.Result, error) {
+	return events.Result{Key: key}, nil
+}
+
+func (m *mockStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	return m.updates, nil
+}
+
+func TestManager(t *testing.T) {
+
+	st := &mockStore{updates: make(chan events.Result, 1)}
+	pipeline.InitStore(st)
+
+	docs := newMockDocuments()
+	m := NewManager(docs)
+
+	query := ast.Node{Type: ast.TypeFaucet, Params: map[string]interface{}{"key": "foo"}}
+
+	_, err := m.Create(Rule{Name: "bad", Query: query, Condition: Condition{Op: "=>"}})
+	assert.Error(t, err)
+
+	_, err = m.Create(Rule{Name: "bad", Query: query, Condition: Condition{Op: ">"}, Notify: []pipeline.SinkConfig{{Name: "pigeon"}}})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "notified")
+	assert.NoError(t, pipeline.ConfigureSinks(map[string]pipeline.SinkConfig{
+		"touch": {Type: pipeline.SinkExec, Params: map[string]interface{}{"command": "touch", "args": []string{path}}},
+	}))
+	defer pipeline.ConfigureSinks(nil)
+	rule, err := m.Create(Rule{Name: "foo", Query: query, Condition: Condition{Op: ">", Threshold: 1}, Notify: []pipeline.SinkConfig{{Name: "touch"}}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rule.ID)
+	assert.Len(t, m.List(), 1)
+
+	st.updates <- events.Result{Key: "foo", Records: []events.Record{{Time: time.Now(), Value: 5}}}
+
+	var history []Transition
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if history, err = m.History(rule.ID, 10); len(history) > 0 {
+			break
+		}
+	}
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, StateFiring, history[0].To)
+		assert.Equal(t, float64(5), history[0].Value)
+	}
+
+	// the transition is sent to the rule's sinks
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Stat(path); err == nil {
+			break
+		}
+	}
+	assert.NoError(t, err)
+
+	docs.lock.Lock()
+	var status Status
+	assert.NoError(t, json.Unmarshal(docs.docs[stateCollection][rule.ID], &status))
+	docs.lock.Unlock()
+	assert.Equal(t, StateFiring, status.State)
+
+	silenced, err := m.Silence(rule.ID, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, silenced.Silenced(time.Now()))
+	_, err = m.Silence("nope", time.Hour)
+	assert.Equal(t, ErrNotFound, err)
+
+	// a new manager restores the rules along with their state
+	m.Stop()
+	m = NewManager(docs)
+	assert.NoError(t, m.Load())
+	rules := m.List()
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, "foo", rules[0].Name)
+		assert.Equal(t, StateFiring, rules[0].Status.State)
+		assert.True(t, rules[0].Silenced(time.Now()))
+	}
+
+	assert.NoError(t, m.Delete(rule.ID))
+	assert.Len(t, m.List(), 0)
+	assert.Len(t, docs.docs[rulesCollection], 0)
+	assert.Equal(t, ErrNotFound, m.Delete(rule.ID))
+	m.Stop()
+}
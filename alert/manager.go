@@ -0,0 +1,377 @@
+package alert
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/pipeline"
+	"github.com/dvirsky/timedis/store"
+)
+
+const (
+	rulesCollection = "alert_rules"
+	stateCollection = "alert_state"
+
+	// maxHistory is the number of transitions we keep per rule
+	maxHistory = 1000
+
+	// tickInterval is how often rules are checked for missing data
+	tickInterval = time.Second
+	// restartDelay is how long we wait before restarting a rule's query after its stream ended
+	restartDelay = 5 * time.Second
+)
+
+// ErrNotFound is returned for operations on rules that do not exist
+var ErrNotFound = errors.New("Alert rule not found")
+
+// RuleStatus is a rule along with its current status
+type RuleStatus struct {
+	Rule
+	Status Status `json:"status"`
+}
+
+// Manager evaluates alert rules continuously in the background, and persists them along with their state and history
+type Manager struct {
+	docs  store.Documents
+	lock  sync.Mutex
+	rules map[string]*runningRule
+}
+
+// runningRule is a rule being evaluated
+type runningRule struct {
+	lock   sync.Mutex
+	eval   *evaluator
+	sinks  []pipeline.Sink
+	stopch chan struct{}
+	done   chan struct{}
+}
+
+func NewManager(docs store.Documents) *Manager {
+	return &Manager{
+		docs:  docs,
+		rules: make(map[string]*runningRule),
+	}
+}
+
+func historyLog(id string) string {
+	return "alert_history::" + id
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Load starts all persisted rules, restoring their last state
+func (m *Manager) Load() error {
+
+	rules, err := m.docs.LoadDocuments(rulesCollection)
+	if err != nil {
+		return err
+	}
+	states, err := m.docs.LoadDocuments(stateCollection)
+	if err != nil {
+		return err
+	}
+
+	for id, doc := range rules {
+		var rule Rule
+		if err := json.Unmarshal(doc, &rule); err != nil {
+			logging.Error("Could not load alert rule %s: %s", id, err)
+			continue
+		}
+
+		var status Status
+		if b, found := states[id]; found {
+			if err := json.Unmarshal(b, &status); err != nil {
+				logging.Warning("Could not load state of alert rule %s: %s", id, err)
+			}
+		}
+
+		m.start(rule, status)
+	}
+
+	logging.Info("Loaded %d alert rules", len(m.rules))
+	return nil
+}
+
+// Create validates and persists a new rule, and starts evaluating it
+func (m *Manager) Create(rule Rule) (Rule, error) {
+
+	if err := rule.Condition.Validate(); err != nil {
+		return rule, err
+	}
+	if _, err := rule.Query.Eval(); err != nil {
+		return rule, fmt.Errorf("Invalid query: %s", err)
+	}
+	if _, err := newSinks(rule.Notify); err != nil {
+		return rule, err
+	}
+
+	rule.ID = newID()
+	if err := m.save(rule); err != nil {
+		return rule, err
+	}
+
+	m.start(rule, Status{})
+	return rule, nil
+}
+
+func (m *Manager) save(rule Rule) error {
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	return m.docs.SaveDocument(rulesCollection, rule.ID, b)
+}
+
+// List returns all rules with their current status
+func (m *Manager) List() []RuleStatus {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make([]RuleStatus, 0, len(m.rules))
+	for _, r := range m.rules {
+		r.lock.Lock()
+		ret = append(ret, RuleStatus{Rule: r.eval.rule, Status: r.eval.status})
+		r.lock.Unlock()
+	}
+	return ret
+}
+
+// Silence marks a rule's transitions as silenced for the given duration. A zero duration unsilences it
+func (m *Manager) Silence(id string, d time.Duration) (Rule, error) {
+
+	m.lock.Lock()
+	r, found := m.rules[id]
+	m.lock.Unlock()
+	if !found {
+		return Rule{}, ErrNotFound
+	}
+
+	r.lock.Lock()
+	r.eval.rule.SilencedUntil = 0
+	if d > 0 {
+		r.eval.rule.SilencedUntil = time.Now().Add(d).Unix()
+	}
+	rule := r.eval.rule
+	r.lock.Unlock()
+
+	return rule, m.save(rule)
+}
+
+// Delete stops a rule and removes it along with its state. Its history is kept
+func (m *Manager) Delete(id string) error {
+
+	m.lock.Lock()
+	r, found := m.rules[id]
+	delete(m.rules, id)
+	m.lock.Unlock()
+	if !found {
+		return ErrNotFound
+	}
+
+	r.stop()
+
+	if err := m.docs.DeleteDocument(rulesCollection, id); err != nil {
+		return err
+	}
+	return m.docs.DeleteDocument(stateCollection, id)
+}
+
+// History returns the last n transitions of a rule, newest first
+func (m *Manager) History(id string, n int) ([]Transition, error) {
+
+	entries, err := m.docs.ReadLog(historyLog(id), n)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Transition, 0, len(entries))
+	for _, b := range entries {
+		var tr Transition
+		if err := json.Unmarshal(b, &tr); err != nil {
+			logging.Warning("Invalid transition in history of %s: %s", id, err)
+			continue
+		}
+		ret = append(ret, tr)
+	}
+	return ret, nil
+}
+
+// Stop stops evaluating all rules
+func (m *Manager) Stop() {
+
+	m.lock.Lock()
+	rules := m.rules
+	m.rules = make(map[string]*runningRule)
+	m.lock.Unlock()
+
+	for _, r := range rules {
+		r.stop()
+	}
+}
+
+func newSinks(configs []pipeline.SinkConfig) ([]pipeline.Sink, error) {
+	ret := make([]pipeline.Sink, 0, len(configs))
+	for _, cfg := range configs {
+		sink, err := pipeline.NewSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sink)
+	}
+	return ret, nil
+}
+
+func (m *Manager) start(rule Rule, status Status) {
+
+	sinks, err := newSinks(rule.Notify)
+	if err != nil {
+		logging.Error("Could not create sinks of alert %s, it won't notify: %s", rule.ID, err)
+	}
+
+	r := &runningRule{
+		eval:   newEvaluator(rule, status, time.Now()),
+		sinks:  sinks,
+		stopch: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	m.lock.Lock()
+	m.rules[rule.ID] = r
+	m.lock.Unlock()
+
+	go m.run(r)
+}
+
+func (r *runningRule) stop() {
+	close(r.stopch)
+	<-r.done
+}
+
+// run evaluates the rule's query until the rule is stopped, restarting the query if its stream ends
+func (m *Manager) run(r *runningRule) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		err := m.evaluate(r, ticker.C)
+		if err == nil {
+			return
+		}
+		logging.Error("Query of alert %s failed: %s", r.eval.rule.ID, err)
+
+		// the stream ended or could not be started; keep checking for missing data until we retry
+		retry := time.After(restartDelay)
+	wait:
+		for {
+			select {
+			case now := <-ticker.C:
+				m.tick(r, now)
+			case <-retry:
+				break wait
+			case <-r.stopch:
+				return
+			}
+		}
+	}
+}
+
+// evaluate streams the rule's query and evaluates its events until the rule is stopped, returning nil, or until the
+// stream ends, returning why
+func (m *Manager) evaluate(r *runningRule, tick <-chan time.Time) error {
+
+	source, err := r.eval.rule.Query.Eval()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := source.Stream(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev, ok := <-stream.Events:
+			if !ok {
+				if err := stream.Err(); err != nil {
+					return err
+				}
+				return errors.New("Stream ended")
+			}
+			r.lock.Lock()
+			tr, changed := r.eval.observe(ev, time.Now())
+			r.lock.Unlock()
+			if changed {
+				m.record(r, tr)
+			}
+		case now := <-tick:
+			m.tick(r, now)
+		case <-r.stopch:
+			return nil
+		}
+	}
+}
+
+func (m *Manager) tick(r *runningRule, now time.Time) {
+	r.lock.Lock()
+	tr, changed := r.eval.tick(now)
+	r.lock.Unlock()
+	if changed {
+		m.record(r, tr)
+	}
+}
+
+// record persists a transition in the rule's history, along with its new state
+func (m *Manager) record(r *runningRule, tr Transition) {
+
+	logging.Info("Alert %s (%s): %s -> %s (%s)", tr.Name, tr.RuleID, tr.From, tr.To, tr.Reason)
+
+	r.lock.Lock()
+	status := r.eval.status
+	r.lock.Unlock()
+
+	if b, err := json.Marshal(status); err == nil {
+		if err := m.docs.SaveDocument(stateCollection, tr.RuleID, b); err != nil {
+			logging.Error("Could not save state of alert %s: %s", tr.RuleID, err)
+		}
+	}
+
+	if b, err := json.Marshal(tr); err == nil {
+		if err := m.docs.AppendLog(historyLog(tr.RuleID), b, maxHistory); err != nil {
+			logging.Error("Could not save transition of alert %s: %s", tr.RuleID, err)
+		}
+	}
+
+	if !tr.Silenced {
+		m.notify(r, tr)
+	}
+}
+
+// notify sends a transition to the rule's sinks in the background, so slow sinks won't hold up evaluation
+func (m *Manager) notify(r *runningRule, tr Transition) {
+	n := tr.Notification()
+	for _, sink := range r.sinks {
+		go func(sink pipeline.Sink) {
+			if err := sink.Send(n); err != nil {
+				logging.Error("Could not notify transition of alert %s: %s", tr.RuleID, err)
+			}
+		}(sink)
+	}
+}
@@ -0,0 +1,200 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/pipeline"
+	"github.com/dvirsky/timedis/query/ast"
+)
+
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+const (
+	ReasonThreshold = "threshold"
+	ReasonNoData    = "nodata"
+)
+
+// Condition decides when a rule fires
+type Condition struct {
+	// Op compares each event's value to Threshold - one of >, >=, <, <=, == or !=
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	// For is how long in seconds the condition must hold before the alert fires. 0 fires immediately
+	For float64 `json:"for,omitempty"`
+	// NoData is how long in seconds without any events before the alert fires. 0 disables it
+	NoData float64 `json:"noData,omitempty"`
+}
+
+func (c Condition) Validate() error {
+	if _, found := comparators[c.Op]; !found {
+		return fmt.Errorf("Invalid condition operator '%s'", c.Op)
+	}
+	if c.For < 0 || c.NoData < 0 {
+		return errors.New("Condition durations can't be negative")
+	}
+	return nil
+}
+
+func (c Condition) Matches(v float64) bool {
+	return comparators[c.Op](v, c.Threshold)
+}
+
+var comparators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Rule is a persisted alert definition - a query evaluated continuously, and a condition on its output
+type Rule struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Query     ast.Node  `json:"query"`
+	Condition Condition `json:"condition"`
+	// SilencedUntil is a unix timestamp until which the rule's transitions are not notified
+	SilencedUntil int64 `json:"silencedUntil,omitempty"`
+	// Notify are the sinks the rule's transitions are sent to
+	Notify []pipeline.SinkConfig `json:"notify,omitempty"`
+}
+
+func (r Rule) Silenced(now time.Time) bool {
+	return r.SilencedUntil > now.Unix()
+}
+
+// Status is the current evaluation state of a rule
+type Status struct {
+	State State `json:"state"`
+	// Since is the unix time the rule entered its state
+	Since int64 `json:"since"`
+	// Value is the last value evaluated
+	Value  float64 `json:"value"`
+	Reason string  `json:"reason,omitempty"`
+	// LastEvent is the unix time of the last event the rule evaluated
+	LastEvent int64 `json:"lastEvent,omitempty"`
+}
+
+// Transition is a change in a rule's state, kept in the rule's history
+type Transition struct {
+	RuleID   string  `json:"ruleId"`
+	Name     string  `json:"name"`
+	From     State   `json:"from"`
+	To       State   `json:"to"`
+	Time     int64   `json:"time"`
+	Value    float64 `json:"value"`
+	Reason   string  `json:"reason"`
+	Silenced bool    `json:"silenced,omitempty"`
+}
+
+// Notification formats the transition for notification sinks
+func (t Transition) Notification() pipeline.Notification {
+	return pipeline.Notification{
+		Key:   t.RuleID,
+		Title: fmt.Sprintf("[%s] %s", t.To, t.Name),
+		Time:  t.Time,
+		Value: t.Value,
+		Annotations: map[string]interface{}{
+			"from":   t.From,
+			"to":     t.To,
+			"reason": t.Reason,
+		},
+	}
+}
+
+// evaluator is the state machine of a single rule
+type evaluator struct {
+	rule   Rule
+	status Status
+	// lastEvent is when we last got an event, in wall clock time, for detecting missing data
+	lastEvent time.Time
+}
+
+func newEvaluator(rule Rule, status Status, now time.Time) *evaluator {
+	if status.State == "" {
+		status = Status{State: StateInactive, Since: now.Unix()}
+	}
+	return &evaluator{rule: rule, status: status, lastEvent: now}
+}
+
+func (e *evaluator) transition(to State, t time.Time, value float64, reason string) (Transition, bool) {
+
+	if to == e.status.State {
+		return Transition{}, false
+	}
+
+	tr := Transition{
+		RuleID:   e.rule.ID,
+		Name:     e.rule.Name,
+		From:     e.status.State,
+		To:       to,
+		Time:     t.Unix(),
+		Value:    value,
+		Reason:   reason,
+		Silenced: e.rule.Silenced(t),
+	}
+
+	e.status.State = to
+	e.status.Since = t.Unix()
+	e.status.Reason = reason
+	return tr, true
+}
+
+// observe evaluates the condition on an event
+func (e *evaluator) observe(ev *events.Event, now time.Time) (Transition, bool) {
+
+	e.lastEvent = now
+	e.status.Value = ev.Value
+	e.status.LastEvent = ev.Time.Unix()
+
+	if !e.rule.Condition.Matches(ev.Value) {
+		switch e.status.State {
+		case StatePending:
+			return e.transition(StateInactive, ev.Time, ev.Value, ReasonThreshold)
+		case StateFiring:
+			return e.transition(StateResolved, ev.Time, ev.Value, ReasonThreshold)
+		}
+		return Transition{}, false
+	}
+
+	switch e.status.State {
+	case StateFiring:
+		// data came back, but it's still over the threshold
+		e.status.Reason = ReasonThreshold
+		return Transition{}, false
+	case StatePending:
+		if ev.Time.Sub(time.Unix(e.status.Since, 0)).Seconds() >= e.rule.Condition.For {
+			return e.transition(StateFiring, ev.Time, ev.Value, ReasonThreshold)
+		}
+		return Transition{}, false
+	}
+
+	if e.rule.Condition.For == 0 {
+		return e.transition(StateFiring, ev.Time, ev.Value, ReasonThreshold)
+	}
+	return e.transition(StatePending, ev.Time, ev.Value, ReasonThreshold)
+}
+
+// tick checks for missing data
+func (e *evaluator) tick(now time.Time) (Transition, bool) {
+
+	if e.rule.Condition.NoData <= 0 || e.status.State == StateFiring {
+		return Transition{}, false
+	}
+
+	if now.Sub(e.lastEvent).Seconds() >= e.rule.Condition.NoData {
+		return e.transition(StateFiring, now, e.status.Value, ReasonNoData)
+	}
+	return Transition{}, false
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"path"
 	"strconv"
@@ -11,8 +16,13 @@ import (
 	"github.com/EverythingMe/vertex"
 	"github.com/EverythingMe/vertex/middleware"
 	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/alert"
 	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/ingest"
+	"github.com/dvirsky/timedis/jobs"
+	"github.com/dvirsky/timedis/pipeline"
 	"github.com/dvirsky/timedis/query"
+	"github.com/dvirsky/timedis/query/ast"
 	"github.com/dvirsky/timedis/sampler"
 )
 
@@ -81,8 +91,210 @@ func (h SampleTimerHandler) Handle(w http.ResponseWriter, r *vertex.Request) (in
 	return "OK", engine.Sampler.Sample(h.Key, h.Value, h.Rate, sampler.SampleTimer)
 }
 
+// maxBodySize caps the size of write and batch request bodies
+const maxBodySize = 32 << 20
+
+// readBody reads a request body up to maxBodySize, decompressing it if it's gzipped. The limit applies to the
+// decompressed body too, so a small gzip bomb can't blow up in memory
+func readBody(w http.ResponseWriter, r *vertex.Request) ([]byte, error) {
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBodySize+1)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBodySize {
+		return nil, fmt.Errorf("Request body is over %d bytes decompressed", maxBodySize)
+	}
+	return b, nil
+}
+
+type WriteHandler struct {
+	Precision string `schema:"precision" maxlen:"2" required:"false" doc:"The unit of the timestamps in the body - n, u, ms, s, m or h. Defaults to nanoseconds"`
+	Database  string `schema:"db" maxlen:"100" required:"false" doc:"Ignored, accepted for compatibility with influx clients"`
+}
+
+func (h WriteHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	precision, err := ingest.ParsePrecision(h.Precision)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	points, errs := ingest.ParseLines(data, precision, time.Now())
+
+	evs := make([]*events.Event, 0, len(points))
+	for _, p := range points {
+		evs = append(evs, p.Events()...)
+	}
+
+	if len(evs) > 0 {
+		if err := engine.Store.Put(evs...); err != nil {
+			return nil, err
+		}
+	}
+
+	// like influx, we write whatever we could parse and report the first bad line
+	if len(errs) > 0 {
+		logging.Warning("Got %d bad lines in write request", len(errs))
+		return nil, fmt.Errorf("partial write: %s (%d lines dropped)", errs[0], len(errs))
+	}
+
+	return "OK", nil
+}
+
+type BatchHandler struct {
+	Format string `schema:"format" maxlen:"10" required:"false" doc:"The body format - json, ndjson or binary. If missing we use the request's content type"`
+}
+
+// BatchResult is the response of a batch request
+type BatchResult struct {
+	Accepted int                `json:"accepted"`
+	Errors   []ingest.ItemError `json:"errors,omitempty"`
+}
+
+func (h BatchHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	format := h.Format
+	if format == "" {
+		switch r.Header.Get("Content-Type") {
+		case "application/x-ndjson", "application/ndjson":
+			format = "ndjson"
+		case "application/octet-stream":
+			format = "binary"
+		default:
+			format = "json"
+		}
+	}
+
+	data, err := readBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch *ingest.Batch
+	now := time.Now()
+	switch format {
+	case "json":
+		batch, err = ingest.DecodeJSON(data, now)
+	case "ndjson":
+		batch, err = ingest.DecodeNDJSON(data, now)
+	case "binary":
+		batch, err = ingest.DecodeBinary(bytes.NewReader(data), now)
+	default:
+		err = fmt.Errorf("Invalid batch format '%s'", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(batch.Events) > 0 {
+		if err := engine.Store.Put(batch.Events...); err != nil {
+			return nil, err
+		}
+	}
+
+	return BatchResult{
+		Accepted: len(batch.Events),
+		Errors:   batch.Errors,
+	}, nil
+}
+
+type SampleTypesHandler struct{}
+
+func (h SampleTypesHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Sampler.Types()
+}
+
+type MetricsHandler struct{}
+
+// Metrics are internal counters for monitoring timedis itself
+type Metrics struct {
+	Sampler sampler.Stats `json:"sampler"`
+}
+
+func (h MetricsHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return Metrics{
+		Sampler: engine.Sampler.Stats(),
+	}, nil
+}
+
+const (
+	// queryTimeout caps how long a bounded query may run
+	queryTimeout = 30 * time.Second
+	// maxQueryEvents caps the number of events a bounded query may return
+	maxQueryEvents = 1000000
+)
+
+type QueryHandler struct {
+	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query, encoded as json or in the text syntax" in:"query"`
+	From  string `schema:"from" maxlen:"32" required:"true" doc:"range start time, formatted as "2006-01-02 15:04:05" (assuming gmt)"`
+	To    string `schema:"to" maxlen:"32" required:"false" doc:"range end time, formatted as "2006-01-02 15:04:05" (assuming gmt). If not present we default to now"`
+}
+
+func (h QueryHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	q, err := query.Parse(h.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := decodeTimestamp(h.From)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now()
+	if h.To != "" {
+		if t, err = decodeTimestamp(h.To); err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := q.Bounded(f, t).Eval()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	return pipeline.Collect(ctx, source, maxQueryEvents)
+}
+
+type ExplainHandler struct {
+	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query, encoded as json or in the text syntax" in:"query"`
+}
+
+func (h ExplainHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return query.Explain(h.Query)
+}
+
+type NodeTypesHandler struct{}
+
+func (h NodeTypesHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return ast.Types(), nil
+}
+
 type SubscribeHandler struct {
-	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query encoded as json" in:"query"`
+	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query, encoded as json or in the text syntax" in:"query"`
 }
 
 func (h SubscribeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
@@ -91,12 +303,16 @@ func (h SubscribeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (inte
 	if err != nil {
 		return nil, err
 	}
-	source, err := q.Eval()
+	source, err := q.EvalShared(engine.Hub)
 	if err != nil {
 		return nil, err
 	}
 
-	ch, stopch, err := source.Stream()
+	// the stream is canceled once the subscriber goes away, or we fail writing to it
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := source.Stream(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +326,7 @@ func (h SubscribeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (inte
 	fmt.Fprintf(w, "retry: 500\n\n")
 	flusher.Flush()
 
-	for record := range ch {
+	for record := range stream.Events {
 
 		b, err := json.Marshal(record)
 		if err == nil {
@@ -120,9 +336,7 @@ func (h SubscribeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (inte
 				flusher.Flush()
 			} else {
 				logging.Error("Could not send message to subscriber: %s, quitting", err)
-				// TODO: close channel so we won't leak
-				stopch <- true
-				break
+				cancel()
 			}
 
 		} else {
@@ -131,9 +345,166 @@ func (h SubscribeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (inte
 
 	}
 
+	// let the subscriber know why the stream ended, unless it was the one that went away
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		b, _ := json.Marshal(map[string]string{"error": err.Error()})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", string(b))
+		flusher.Flush()
+	}
+
 	return nil, vertex.Hijacked
 }
 
+type CreateAlertHandler struct {
+	Name      string  `schema:"name" maxlen:"200" required:"true" doc:"A human readable name for the alert"`
+	Query     string  `schema:"query" maxlen:"10000" required:"true" doc:"The query to evaluate, encoded as json or in the text syntax"`
+	Op        string  `schema:"op" maxlen:"2" required:"true" doc:"How query values are compared to the threshold - one of >, >=, <, <=, == or !="`
+	Threshold float64 `schema:"threshold" required:"true" doc:"The value the condition compares query values to"`
+	For       float64 `schema:"for" required:"false" default:"0" doc:"Seconds the condition must hold before the alert fires. Defaults to firing immediately"`
+	NoData    float64 `schema:"nodata" required:"false" default:"0" doc:"Seconds without any values before the alert fires. Defaults to never"`
+	Notify    string  `schema:"notify" maxlen:"10000" required:"false" doc:"The sinks to notify of transitions, as a json array of {name,limit,per,group} objects naming sinks configured on the server"`
+}
+
+func (h CreateAlertHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	q, err := query.Parse(h.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []pipeline.SinkConfig
+	if h.Notify != "" {
+		if err := json.Unmarshal([]byte(h.Notify), &sinks); err != nil {
+			return nil, err
+		}
+	}
+
+	return engine.Alerts.Create(alert.Rule{
+		Name:   h.Name,
+		Query:  q,
+		Notify: sinks,
+		Condition: alert.Condition{
+			Op:        h.Op,
+			Threshold: h.Threshold,
+			For:       h.For,
+			NoData:    h.NoData,
+		},
+	})
+}
+
+type ListAlertsHandler struct{}
+
+func (h ListAlertsHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Alerts.List(), nil
+}
+
+type SilenceAlertHandler struct {
+	Id       string `schema:"id" maxlen:"100" required:"true" doc:"The alert's id" in:"path"`
+	Duration string `schema:"duration" maxlen:"32" required:"true" doc:"How long to silence the alert for, e.g. 30m. 0 unsilences it"`
+}
+
+func (h SilenceAlertHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	d, err := time.ParseDuration(h.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.Alerts.Silence(h.Id, d)
+}
+
+type DeleteAlertHandler struct {
+	Id string `schema:"id" maxlen:"100" required:"true" doc:"The alert's id" in:"path"`
+}
+
+func (h DeleteAlertHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return "OK", engine.Alerts.Delete(h.Id)
+}
+
+type AlertHistoryHandler struct {
+	Id    string `schema:"id" maxlen:"100" required:"true" doc:"The alert's id" in:"path"`
+	Limit int    `schema:"limit" required:"false" default:"100" doc:"How many transitions to return, newest first"`
+}
+
+func (h AlertHistoryHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Alerts.History(h.Id, h.Limit)
+}
+
+type MaterializeHandler struct {
+	Key   string `schema:"key" maxlen:"1000" pattern:"[a-zA-Z_\.]+" required:"true" doc:"The key the query's output is stored in"`
+	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query, encoded as json or in the text syntax"`
+	Name  string `schema:"name" maxlen:"200" required:"false" doc:"A human readable name for the job. Defaults to the key"`
+}
+
+func (h MaterializeHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	q, err := query.Parse(h.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	name := h.Name
+	if name == "" {
+		name = h.Key
+	}
+	return engine.Jobs.Create(jobs.Materialize(name, h.Key, q))
+}
+
+type CreateJobHandler struct {
+	Name  string `schema:"name" maxlen:"200" required:"true" doc:"A human readable name for the job"`
+	Query string `schema:"query" maxlen:"10000" required:"true" doc:"The query, encoded as json or in the text syntax. Its output is discarded, so it should end in a sink such as store or notify"`
+}
+
+func (h CreateJobHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	q, err := query.Parse(h.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.Jobs.Create(jobs.Job{Name: h.Name, Query: q})
+}
+
+type ListJobsHandler struct{}
+
+func (h ListJobsHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Jobs.List(), nil
+}
+
+type JobHandler struct {
+	Id string `schema:"id" maxlen:"100" required:"true" doc:"The job's id" in:"path"`
+}
+
+func (h JobHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Jobs.Get(h.Id)
+}
+
+type PauseJobHandler JobHandler
+
+func (h PauseJobHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Jobs.Pause(h.Id)
+}
+
+type ResumeJobHandler JobHandler
+
+func (h ResumeJobHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return engine.Jobs.Resume(h.Id)
+}
+
+type DeleteJobHandler JobHandler
+
+func (h DeleteJobHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+
+	return "OK", engine.Jobs.Delete(h.Id)
+}
+
 func decodeTimestamp(ts string) (time.Time, error) {
 	return time.Parse(timeFormat, ts)
 }
@@ -196,6 +567,20 @@ func init() {
 					Methods:     vertex.POST,
 					Returns:     "OK",
 				},
+				{
+					Path:        "/entries",
+					Description: "Post a batch of entries, as a JSON array or newline delimited JSON of {key,time,value} objects, or in the compact binary format",
+					Handler:     BatchHandler{},
+					Methods:     vertex.POST,
+					Returns:     BatchResult{},
+				},
+				{
+					Path:        "/write",
+					Description: "Write points in InfluxDB line protocol. Each measurement field is stored as measurement[.tag values].field",
+					Handler:     WriteHandler{},
+					Methods:     vertex.POST,
+					Returns:     "OK",
+				},
 				{
 					Path:        "/sample/counter/{key}",
 					Description: "Post a counter sample",
@@ -210,6 +595,13 @@ func init() {
 					Methods:     vertex.POST,
 					Returns:     "OK",
 				},
+				{
+					Path:        "/sample/types",
+					Description: "Get the sample type (counter or timer) of every sampled key",
+					Handler:     SampleTypesHandler{},
+					Methods:     vertex.GET,
+					Returns:     map[string]string{},
+				},
 				{
 					Path:        "/range/{key}",
 					Description: "Get the values in a time range",
@@ -217,6 +609,27 @@ func init() {
 					Methods:     vertex.GET,
 					Returns:     events.Result{},
 				},
+				{
+					Path:        "/query",
+					Description: "Run a query over a past time range, and get its output once it's done",
+					Handler:     QueryHandler{},
+					Methods:     vertex.GET,
+					Returns:     []events.Result{},
+				},
+				{
+					Path:        "/query/explain",
+					Description: "Validate a query, and get its plan with the defaults of all params filled in",
+					Handler:     ExplainHandler{},
+					Methods:     vertex.GET,
+					Returns:     query.Plan{},
+				},
+				{
+					Path:        "/query/types",
+					Description: "List the node types queries can use, with their params and documentation",
+					Handler:     NodeTypesHandler{},
+					Methods:     vertex.GET,
+					Returns:     []ast.NodeType{},
+				},
 				{
 					Path:        "/subscribe",
 					Description: "Subscribe to changes in a series",
@@ -224,6 +637,97 @@ func init() {
 					Methods:     vertex.GET,
 					Returns:     events.Result{},
 				},
+				{
+					Path:        "/internal/metrics",
+					Description: "Internal counters of the sampler's flushing",
+					Handler:     MetricsHandler{},
+					Methods:     vertex.GET,
+					Returns:     Metrics{},
+				},
+				{
+					Path:        "/materialize",
+					Description: "Store the output of a query continuously in a key of its own, so it can be queried by /range. Runs as a background job",
+					Handler:     MaterializeHandler{},
+					Methods:     vertex.POST,
+					Returns:     jobs.Job{},
+				},
+				{
+					Path:        "/jobs",
+					Description: "Create a job running a query continuously in the background, restarting it if it fails",
+					Handler:     CreateJobHandler{},
+					Methods:     vertex.POST,
+					Returns:     jobs.Job{},
+				},
+				{
+					Path:        "/jobs",
+					Description: "List all jobs along with their status",
+					Handler:     ListJobsHandler{},
+					Methods:     vertex.GET,
+					Returns:     []jobs.JobStatus{},
+				},
+				{
+					Path:        "/jobs/{id}",
+					Description: "Get a job along with its status",
+					Handler:     JobHandler{},
+					Methods:     vertex.GET,
+					Returns:     jobs.JobStatus{},
+				},
+				{
+					Path:        "/jobs/{id}/pause",
+					Description: "Stop running a job until it's resumed",
+					Handler:     PauseJobHandler{},
+					Methods:     vertex.POST,
+					Returns:     jobs.JobStatus{},
+				},
+				{
+					Path:        "/jobs/{id}/resume",
+					Description: "Resume running a paused job",
+					Handler:     ResumeJobHandler{},
+					Methods:     vertex.POST,
+					Returns:     jobs.JobStatus{},
+				},
+				{
+					Path:        "/jobs/{id}",
+					Description: "Stop and delete a job",
+					Handler:     DeleteJobHandler{},
+					Methods:     vertex.DELETE,
+					Returns:     "OK",
+				},
+				{
+					Path:        "/alerts",
+					Description: "Create an alert rule, evaluating a query continuously against a threshold condition",
+					Handler:     CreateAlertHandler{},
+					Methods:     vertex.POST,
+					Returns:     alert.Rule{},
+				},
+				{
+					Path:        "/alerts",
+					Description: "List all alert rules along with their current state",
+					Handler:     ListAlertsHandler{},
+					Methods:     vertex.GET,
+					Returns:     []alert.RuleStatus{},
+				},
+				{
+					Path:        "/alerts/{id}/silence",
+					Description: "Silence an alert's notifications for a while",
+					Handler:     SilenceAlertHandler{},
+					Methods:     vertex.POST,
+					Returns:     alert.Rule{},
+				},
+				{
+					Path:        "/alerts/{id}/history",
+					Description: "Get the state transitions of an alert, newest first",
+					Handler:     AlertHistoryHandler{},
+					Methods:     vertex.GET,
+					Returns:     []alert.Transition{},
+				},
+				{
+					Path:        "/alerts/{id}",
+					Description: "Delete an alert rule",
+					Handler:     DeleteAlertHandler{},
+					Methods:     vertex.DELETE,
+					Returns:     "OK",
+				},
 
 				{
 					Path:        "/html/*filepath",
@@ -27,6 +27,46 @@ func (r Record) MarshalJSON() ([]byte, error) {
 type Event struct {
 	Record
 	Key string
+	// Annotations are extra values attached to the event by pipeline operators, e.g. anomaly scores
+	Annotations map[string]interface{}
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+
+	s := struct {
+		Time        int64                  `json:"time"`
+		Value       float64                `json:"y"`
+		Key         string                 `json:"key"`
+		Annotations map[string]interface{} `json:"annotations,omitempty"`
+	}{
+		Time:        e.Time.Unix(),
+		Value:       e.Value,
+		Key:         e.Key,
+		Annotations: e.Annotations,
+	}
+
+	return json.Marshal(s)
+}
+
+// Clone returns a copy of the event that can be annotated without affecting the original
+func (e *Event) Clone() *Event {
+	ret := *e
+	if e.Annotations != nil {
+		ret.Annotations = make(map[string]interface{}, len(e.Annotations))
+		for k, v := range e.Annotations {
+			ret.Annotations[k] = v
+		}
+	}
+	return &ret
+}
+
+// Annotate sets an annotation on the event, and returns the event for chaining
+func (e *Event) Annotate(key string, val interface{}) *Event {
+	if e.Annotations == nil {
+		e.Annotations = make(map[string]interface{})
+	}
+	e.Annotations[key] = val
+	return e
 }
 
 func NewEvent(key string, t time.Time, val float64) *Event {
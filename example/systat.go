@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/akhenakh/statgo"
 	"github.com/dvirsky/go-pylog/logging"
 )
 
-func putStat(key string, val interface{}) error {
+type entry struct {
+	Key   string      `json:"key"`
+	Time  int64       `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// putStats posts all the stats of one sampling round in a single batch request
+func putStats(entries []entry) error {
 
-	res, err := http.Post(fmt.Sprintf("http://localhost:9944/entry/%s?value=%v", url.QueryEscape(key), val), "form/www-urlencoded", nil)
+	b, err := json.Marshal(entries)
 	if err != nil {
-		logging.Error("Error sending stat: %s", err)
+		return err
+	}
+
+	res, err := http.Post("http://localhost:9944/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		logging.Error("Error sending stats: %s", err)
 		return err
 	}
 	res.Body.Close()
@@ -23,20 +36,28 @@ func putStat(key string, val interface{}) error {
 
 func sampleStats() {
 	stat := statgo.NewStat()
-	for range time.Tick(time.Second) {
+	for tm := range time.Tick(time.Second) {
+
+		ts := tm.Unix()
+		var entries []entry
+		add := func(key string, val interface{}) {
+			entries = append(entries, entry{Key: key, Time: ts, Value: val})
+		}
 
 		for _, iface := range stat.NetIOStats() {
-			putStat(fmt.Sprintf("sys.net.%s.tx", iface.IntName), iface.TX)
-			putStat(fmt.Sprintf("sys.net.%s.rx", iface.IntName), iface.RX)
+			add(fmt.Sprintf("sys.net.%s.tx", iface.IntName), iface.TX)
+			add(fmt.Sprintf("sys.net.%s.rx", iface.IntName), iface.RX)
 		}
-		putStat("sys.cpu.user", stat.CPUStats().User)
-		putStat("sys.cpu.idle", stat.CPUStats().Idle)
-		putStat("sys.cpu.kernel", stat.CPUStats().Kernel)
-		putStat("sys.cpu.load", stat.CPUStats().LoadMin1)
-		putStat("sys.mem.used", stat.MemStats().Used)
-		putStat("sys.mem.free", stat.MemStats().Free)
-		putStat("sys.mem.cached", stat.MemStats().Cache)
-		putStat("sys.mem.total", stat.MemStats().Total)
+		add("sys.cpu.user", stat.CPUStats().User)
+		add("sys.cpu.idle", stat.CPUStats().Idle)
+		add("sys.cpu.kernel", stat.CPUStats().Kernel)
+		add("sys.cpu.load", stat.CPUStats().LoadMin1)
+		add("sys.mem.used", stat.MemStats().Used)
+		add("sys.mem.free", stat.MemStats().Free)
+		add("sys.mem.cached", stat.MemStats().Cache)
+		add("sys.mem.total", stat.MemStats().Total)
+
+		putStats(entries)
 	}
 }
 
@@ -0,0 +1,232 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+const (
+	// MaxKeyLen is the longest key we accept in a batch
+	MaxKeyLen = 1000
+
+	// TimeFormat is the format of string timestamps in JSON batches, same as the single entry API
+	TimeFormat = "2006-01-02 15:04:05"
+)
+
+// Entry is a single item of a JSON batch. Time can either be a number of (possibly fractional) unix seconds,
+// or a string formatted as TimeFormat. If it is missing, the time of ingestion is used
+type Entry struct {
+	Key   string          `json:"key"`
+	Time  json.RawMessage `json:"time,omitempty"`
+	Value *float64        `json:"value"`
+}
+
+// ItemError reports a batch item that could not be ingested
+type ItemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// Batch is the result of decoding a batch request: the valid events and the errors for the invalid items
+type Batch struct {
+	Events []*events.Event
+	Errors []ItemError
+}
+
+func (b *Batch) fail(idx int, err error) {
+	b.Errors = append(b.Errors, ItemError{Index: idx, Error: err.Error()})
+}
+
+// DecodeJSON decodes a JSON array of entries
+func DecodeJSON(data []byte, now time.Time) (*Batch, error) {
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	b := &Batch{Events: make([]*events.Event, 0, len(raw))}
+	for i, item := range raw {
+		b.decodeEntry(i, item, now)
+	}
+	return b, nil
+}
+
+// DecodeNDJSON decodes newline delimited JSON entries, one per line. Empty lines are skipped but still counted
+// for the item indexes reported in errors
+func DecodeNDJSON(data []byte, now time.Time) (*Batch, error) {
+
+	b := &Batch{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for i := 0; scanner.Scan(); i++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		b.decodeEntry(i, line, now)
+	}
+
+	return b, scanner.Err()
+}
+
+func (b *Batch) decodeEntry(idx int, data []byte, now time.Time) {
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		b.fail(idx, err)
+		return
+	}
+
+	if err := validateKey(e.Key); err != nil {
+		b.fail(idx, err)
+		return
+	}
+
+	if e.Value == nil {
+		b.fail(idx, errors.New("missing value"))
+		return
+	}
+	if err := validateValue(*e.Value); err != nil {
+		b.fail(idx, err)
+		return
+	}
+
+	tm, err := decodeEntryTime(e.Time, now)
+	if err != nil {
+		b.fail(idx, err)
+		return
+	}
+
+	b.Events = append(b.Events, events.NewEvent(e.Key, tm, *e.Value))
+}
+
+func decodeEntryTime(raw json.RawMessage, now time.Time) (time.Time, error) {
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return now, nil
+	}
+
+	var secs float64
+	if err := json.Unmarshal(raw, &secs); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return now, fmt.Errorf("invalid time %s", string(raw))
+	}
+	return time.Parse(TimeFormat, s)
+}
+
+// binaryRecord is the fixed size part of a binary batch record, following the key
+type binaryRecord struct {
+	Time  int64
+	Value float64
+}
+
+// DecodeBinary decodes the compact binary batch format. The body is a sequence of records, each encoded as:
+//
+//	uint16 key length | key bytes | int64 unix time in nanoseconds (0 means now) | float64 value
+//
+// All numbers are big endian. Since records are not self delimiting, a truncated record aborts decoding,
+// but the records before it are kept
+func DecodeBinary(r io.Reader, now time.Time) (*Batch, error) {
+
+	b := &Batch{}
+	br := bufio.NewReader(r)
+
+	for idx := 0; ; idx++ {
+
+		var keyLen uint16
+		if err := binary.Read(br, binary.BigEndian, &keyLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			b.fail(idx, err)
+			break
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			b.fail(idx, fmt.Errorf("truncated key: %s", err))
+			break
+		}
+
+		var rec binaryRecord
+		if err := binary.Read(br, binary.BigEndian, &rec); err != nil {
+			b.fail(idx, fmt.Errorf("truncated record: %s", err))
+			break
+		}
+
+		if err := validateKey(string(key)); err != nil {
+			b.fail(idx, err)
+			continue
+		}
+		if err := validateValue(rec.Value); err != nil {
+			b.fail(idx, err)
+			continue
+		}
+
+		tm := now
+		if rec.Time != 0 {
+			tm = time.Unix(0, rec.Time)
+		}
+		b.Events = append(b.Events, events.NewEvent(string(key), tm, rec.Value))
+	}
+
+	return b, nil
+}
+
+// EncodeBinary writes events in the binary batch format, for clients written in Go
+func EncodeBinary(w io.Writer, evs ...*events.Event) error {
+
+	for _, ev := range evs {
+		if len(ev.Key) > math.MaxUint16 {
+			return fmt.Errorf("key too long: %d", len(ev.Key))
+		}
+		if err := binary.Write(w, binary.BigEndian, uint16(len(ev.Key))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, ev.Key); err != nil {
+			return err
+		}
+		rec := binaryRecord{Time: ev.Time.UnixNano(), Value: ev.Value}
+		if err := binary.Write(w, binary.BigEndian, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateKey(key string) error {
+	if key == "" {
+		return errors.New("missing key")
+	}
+	if len(key) > MaxKeyLen {
+		return fmt.Errorf("key too long: %d", len(key))
+	}
+	if strings.ContainsAny(key, " \t\r\n") {
+		return fmt.Errorf("invalid key '%s'", key)
+	}
+	return nil
+}
+
+func validateValue(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid value %v", v)
+	}
+	return nil
+}
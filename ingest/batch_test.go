@@ -0,0 +1,75 @@
+package ingest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeJSON(t *testing.T) {
+
+	now := time.Now()
+	data := []byte(`[
+		{"key":"foo.bar","time":1436400000,"value":1},
+		{"key":"foo.baz","time":"2015-07-09 00:00:01","value":2.5},
+		{"key":"foo.now","value":3},
+		{"key":"","value":4},
+		{"key":"foo.bar"},
+		{"key":"foo.bar","time":"yesterday","value":5}
+	]`)
+
+	b, err := DecodeJSON(data, now)
+	assert.NoError(t, err)
+	assert.Len(t, b.Events, 3)
+	assert.Equal(t, int64(1436400000), b.Events[0].Time.Unix())
+	assert.Equal(t, int64(1436400001), b.Events[1].Time.Unix())
+	assert.Equal(t, 2.5, b.Events[1].Value)
+	assert.Equal(t, now, b.Events[2].Time)
+
+	assert.Len(t, b.Errors, 3)
+	assert.Equal(t, 3, b.Errors[0].Index)
+	assert.Equal(t, 4, b.Errors[1].Index)
+	assert.Equal(t, 5, b.Errors[2].Index)
+
+	_, err = DecodeJSON([]byte(`{"key":"foo"}`), now)
+	assert.Error(t, err)
+}
+
+func TestDecodeNDJSON(t *testing.T) {
+
+	data := []byte("{\"key\":\"foo.bar\",\"value\":1}\n\nnot json\n{\"key\":\"foo.baz\",\"value\":2}\n")
+
+	b, err := DecodeNDJSON(data, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, b.Events, 2)
+	assert.Len(t, b.Errors, 1)
+	assert.Equal(t, 2, b.Errors[0].Index)
+}
+
+func TestBinary(t *testing.T) {
+
+	tm := time.Unix(1436400000, 500)
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, EncodeBinary(buf,
+		events.NewEvent("foo.bar", tm, 1),
+		events.NewEvent("foo.baz", tm, 3.141),
+	))
+
+	b, err := DecodeBinary(bytes.NewReader(buf.Bytes()), time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, b.Errors, 0)
+	assert.Len(t, b.Events, 2)
+	assert.Equal(t, "foo.baz", b.Events[1].Key)
+	assert.Equal(t, 3.141, b.Events[1].Value)
+	assert.Equal(t, tm.UnixNano(), b.Events[1].Time.UnixNano())
+
+	// truncated record keeps what came before it
+	b, err = DecodeBinary(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, b.Events, 1)
+	assert.Len(t, b.Errors, 1)
+	assert.Equal(t, 1, b.Errors[0].Index)
+}
@@ -0,0 +1,331 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+// Tag is a single key=value pair of a line protocol point's tag set
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Point is a single parsed line of InfluxDB line protocol.
+// Since the store only holds numeric values, string fields are dropped and booleans are converted to 0/1
+type Point struct {
+	Measurement string
+	// Tags are sorted by key, so the same series always maps to the same keys
+	Tags   []Tag
+	Fields map[string]float64
+	// Time is the point's timestamp. If the line had no timestamp it is set to the time of parsing
+	Time time.Time
+}
+
+// LineError is a parse error of a specific line in a line protocol payload
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// ParsePrecision converts an influx precision parameter (n, u, ms, s, m, h) to the duration of a timestamp unit.
+// An empty precision means nanoseconds
+func ParsePrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("Invalid precision '%s'", p)
+}
+
+// ParseLines parses a line protocol payload. Lines that cannot be parsed are skipped and reported as LineErrors,
+// so valid points can still be written (this is what influx itself does with partial writes).
+// Timestamps are interpreted in units of precision, and points without a timestamp get now
+func ParseLines(data []byte, precision time.Duration, now time.Time) ([]Point, []error) {
+
+	var points []Point
+	var errs []error
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p, err := ParsePoint(line, precision, now)
+		if err != nil {
+			errs = append(errs, LineError{Line: lineNum, Err: err})
+			continue
+		}
+		points = append(points, p)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return points, errs
+}
+
+// ParsePoint parses a single line of line protocol
+func ParsePoint(line string, precision time.Duration, now time.Time) (Point, error) {
+
+	sections, err := splitSections(line)
+	if err != nil {
+		return Point{}, err
+	}
+
+	if len(sections) < 2 {
+		return Point{}, errors.New("missing fields")
+	}
+	if len(sections) > 3 {
+		return Point{}, errors.New("too many sections")
+	}
+
+	p := Point{
+		Fields: make(map[string]float64),
+		Time:   now,
+	}
+
+	// measurement and tag set
+	seriesParts := splitUnescaped(sections[0], ',')
+	if p.Measurement = unescape(seriesParts[0]); p.Measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+	for _, part := range seriesParts[1:] {
+		kv := splitUnescaped(part, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return Point{}, fmt.Errorf("invalid tag '%s'", part)
+		}
+		p.Tags = append(p.Tags, Tag{Key: unescape(kv[0]), Value: unescape(kv[1])})
+	}
+	sort.Sort(tagsByKey(p.Tags))
+
+	// field set
+	for _, part := range splitFields(sections[1]) {
+		kv := splitUnescaped(part, '=')
+		if len(kv) < 2 || kv[0] == "" {
+			return Point{}, fmt.Errorf("invalid field '%s'", part)
+		}
+		// string values may contain unescaped '=' signs
+		raw := strings.Join(kv[1:], "=")
+		val, numeric, err := parseFieldValue(raw)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid value for field '%s': %s", kv[0], err)
+		}
+		if numeric {
+			p.Fields[unescape(kv[0])] = val
+		}
+	}
+
+	// timestamp
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp '%s'", sections[2])
+		}
+		// the timestamp must fit in nanoseconds
+		if max := math.MaxInt64 / int64(precision); ts > max || ts < -max {
+			return Point{}, fmt.Errorf("timestamp '%s' out of range", sections[2])
+		}
+		p.Time = time.Unix(0, ts*int64(precision))
+	}
+
+	return p, nil
+}
+
+// Key returns the store key for one of the point's fields, in the form of measurement[.tag values...].field.
+// The store has no notion of tags, so tag values are folded into the key ordered by tag key, e.g.
+// net,host=foo,interface=eth0 bytes_recv=3 becomes net.foo.eth0.bytes_recv
+func (p Point) Key(field string) string {
+
+	parts := make([]string, 0, len(p.Tags)+2)
+	parts = append(parts, sanitizeKeyPart(p.Measurement))
+	for _, t := range p.Tags {
+		parts = append(parts, sanitizeKeyPart(t.Value))
+	}
+	parts = append(parts, sanitizeKeyPart(field))
+
+	return strings.Join(parts, ".")
+}
+
+// Events converts the point into one event per field
+func (p Point) Events() []*events.Event {
+
+	ret := make([]*events.Event, 0, len(p.Fields))
+	for field, val := range p.Fields {
+		ret = append(ret, events.NewEvent(p.Key(field), p.Time, val))
+	}
+	return ret
+}
+
+type tagsByKey []Tag
+
+func (t tagsByKey) Len() int           { return len(t) }
+func (t tagsByKey) Less(i, j int) bool { return t[i].Key < t[j].Key }
+func (t tagsByKey) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// sanitizeKeyPart replaces characters that would break the dotted key hierarchy
+func sanitizeKeyPart(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '/', ' ', '\t', ',', '=', ':':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// splitSections splits a line on unescaped spaces outside of quoted field values
+func splitSections(line string) ([]string, error) {
+
+	var ret []string
+	start := 0
+	inQuote := false
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			// quotes only have a meaning in the field set
+			if len(ret) == 1 {
+				inQuote = !inQuote
+			}
+		case ' ':
+			if inQuote {
+				continue
+			}
+			if i > start {
+				ret = append(ret, line[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated string")
+	}
+	if start < len(line) {
+		ret = append(ret, line[start:])
+	}
+	return ret, nil
+}
+
+// splitFields splits the field set on unescaped commas outside of quoted string values
+func splitFields(s string) []string {
+
+	var ret []string
+	start := 0
+	inQuote := false
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuote = !inQuote
+		case ',':
+			if !inQuote {
+				ret = append(ret, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ret, s[start:])
+}
+
+// splitUnescaped splits s on sep, ignoring backslash escaped separators
+func splitUnescaped(s string, sep byte) []string {
+	var ret []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, s[start:])
+}
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', '=', ' ', '"', '\\':
+				i++
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// parseFieldValue parses a field value. numeric is false for string values, which we do not store
+func parseFieldValue(raw string) (val float64, numeric bool, err error) {
+
+	if raw == "" {
+		return 0, false, errors.New("empty value")
+	}
+
+	if raw[0] == '"' {
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(n), err == nil, err
+	case 'u':
+		n, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(n), err == nil, err
+	}
+
+	val, err = strconv.ParseFloat(raw, 64)
+	return val, err == nil, err
+}
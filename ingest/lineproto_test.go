@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePoint(t *testing.T) {
+
+	now := time.Now()
+
+	p, err := ParsePoint(`cpu,host=foo,cpu=cpu0 usage_user=1.5,usage_idle=90i,up=true,name="a, b=c" 1465839830100400200`, time.Nanosecond, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", p.Measurement)
+	assert.Equal(t, []Tag{{"cpu", "cpu0"}, {"host", "foo"}}, p.Tags)
+	assert.Len(t, p.Fields, 3)
+	assert.Equal(t, 1.5, p.Fields["usage_user"])
+	assert.Equal(t, float64(90), p.Fields["usage_idle"])
+	assert.Equal(t, float64(1), p.Fields["up"])
+	assert.Equal(t, int64(1465839830100400200), p.Time.UnixNano())
+
+	assert.Equal(t, "cpu.cpu0.foo.usage_user", p.Key("usage_user"))
+	assert.Len(t, p.Events(), 3)
+
+	// escaping and no timestamp
+	p, err = ParsePoint(`disk\ io,path=/mnt/a\,b read\ bytes=3u`, time.Second, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "disk io", p.Measurement)
+	assert.Equal(t, "/mnt/a,b", p.Tags[0].Value)
+	assert.Equal(t, float64(3), p.Fields["read bytes"])
+	assert.Equal(t, now, p.Time)
+	assert.Equal(t, "disk_io._mnt_a_b.read_bytes", p.Key("read bytes"))
+
+	// precision
+	p, err = ParsePoint(`mem free=10 1465839830`, time.Second, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1465839830), p.Time.Unix())
+
+	// timestamps that overflow nanoseconds at their precision are rejected
+	_, err = ParsePoint(`mem free=10 9223372036854775807`, time.Second, now)
+	assert.Error(t, err)
+	_, err = ParsePoint(`mem free=10 -9223372036854775807`, time.Millisecond, now)
+	assert.Error(t, err)
+	p, err = ParsePoint(`mem free=10 9223372036`, time.Second, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9223372036), p.Time.Unix())
+
+	for _, bad := range []string{
+		"cpu",
+		"cpu,host usage=1",
+		"cpu usage=",
+		"cpu usage=abc",
+		"cpu usage=1 notatime",
+		`cpu name="unterminated`,
+	} {
+		_, err := ParsePoint(bad, time.Nanosecond, now)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+
+	data := []byte("# comment\ncpu usage=1 1000000000\n\nbad line\nmem used=2i 2000000000\n")
+
+	points, errs := ParseLines(data, time.Nanosecond, time.Now())
+	assert.Len(t, points, 2)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 4, errs[0].(LineError).Line)
+	assert.Equal(t, int64(2), points[1].Time.Unix())
+}
+
+func TestParsePrecision(t *testing.T) {
+
+	p, err := ParsePrecision("ms")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Millisecond, p)
+
+	p, err = ParsePrecision("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Nanosecond, p)
+
+	_, err = ParsePrecision("x")
+	assert.Error(t, err)
+}
@@ -0,0 +1,391 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/query/ast"
+	"github.com/dvirsky/timedis/store"
+)
+
+const (
+	jobsCollection = "jobs"
+
+	// restartDelay is how long we wait before restarting a job whose stream ended or failed
+	restartDelay = 5 * time.Second
+)
+
+const (
+	StateRunning    = "running"
+	StatePaused     = "paused"
+	StateRestarting = "restarting"
+)
+
+// ErrNotFound is returned for operations on jobs that do not exist
+var ErrNotFound = errors.New("Job not found")
+
+// Job is a persisted pipeline running in the background. Its output is discarded, so it's useful for pipelines
+// ending in a sink, e.g. storing a derived series or sending notifications
+type Job struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Query  ast.Node `json:"query"`
+	Paused bool     `json:"paused,omitempty"`
+}
+
+// Materialize returns a job storing the output of a query in key
+func Materialize(name, key string, query ast.Node) Job {
+	return Job{
+		Name: name,
+		Query: ast.Node{
+			Type:     ast.TypeStore,
+			Params:   map[string]interface{}{"key": key},
+			Children: []ast.Node{query},
+		},
+	}
+}
+
+// Status is the runtime state of a job. It is not persisted
+type Status struct {
+	State string `json:"state"`
+	// Started is the unix time the job's pipeline was last started
+	Started  int64 `json:"started,omitempty"`
+	Restarts int   `json:"restarts"`
+	// LastError is the last error the pipeline failed with, and ErrorTime the unix time it happened
+	LastError string `json:"lastError,omitempty"`
+	ErrorTime int64  `json:"errorTime,omitempty"`
+}
+
+// JobStatus is a job along with its status
+type JobStatus struct {
+	Job
+	Status Status `json:"status"`
+}
+
+// Manager runs jobs and persists their definitions, so they are restarted along with the server
+type Manager struct {
+	docs  store.Documents
+	lock  sync.Mutex
+	jobs  map[string]*runningJob
+	delay time.Duration
+}
+
+// runningJob is a job along with its status. stopch and done are only set while it's running
+type runningJob struct {
+	lock   sync.Mutex
+	job    Job
+	status Status
+	stopch chan struct{}
+	done   chan struct{}
+}
+
+func NewManager(docs store.Documents) *Manager {
+	return &Manager{
+		docs:  docs,
+		jobs:  make(map[string]*runningJob),
+		delay: restartDelay,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Load starts all persisted jobs, except for the paused ones
+func (m *Manager) Load() error {
+
+	docs, err := m.docs.LoadDocuments(jobsCollection)
+	if err != nil {
+		return err
+	}
+
+	for id, doc := range docs {
+		var job Job
+		if err := json.Unmarshal(doc, &job); err != nil {
+			logging.Error("Could not load job %s: %s", id, err)
+			continue
+		}
+		m.add(job)
+	}
+
+	logging.Info("Loaded %d jobs", len(docs))
+	return nil
+}
+
+// Create validates and persists a new job, and starts running it
+func (m *Manager) Create(job Job) (Job, error) {
+
+	// the query may be wrapped after it was parsed, e.g. by Materialize, so it's validated as a whole again
+	if err := job.Query.Validate(); err != nil {
+		return job, err
+	}
+	if _, err := job.Query.Eval(); err != nil {
+		return job, fmt.Errorf("Invalid query: %s", err)
+	}
+
+	job.ID = newID()
+	if err := m.save(job); err != nil {
+		return job, err
+	}
+
+	m.add(job)
+	return job, nil
+}
+
+func (m *Manager) save(job Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return m.docs.SaveDocument(jobsCollection, job.ID, b)
+}
+
+// add registers a job, starting it unless it's paused
+func (m *Manager) add(job Job) {
+
+	j := &runningJob{job: job, status: Status{State: StatePaused}}
+
+	m.lock.Lock()
+	m.jobs[job.ID] = j
+	m.lock.Unlock()
+
+	if !job.Paused {
+		m.start(j)
+	}
+}
+
+func (m *Manager) get(id string) (*runningJob, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	j, found := m.jobs[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+// List returns all jobs with their status
+func (m *Manager) List() []JobStatus {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make([]JobStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		ret = append(ret, j.jobStatus())
+	}
+	return ret
+}
+
+// Get returns a job with its status
+func (m *Manager) Get(id string) (JobStatus, error) {
+	j, err := m.get(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	return j.jobStatus(), nil
+}
+
+// Pause stops a job until it's resumed, including across restarts
+func (m *Manager) Pause(id string) (JobStatus, error) {
+	return m.setPaused(id, true)
+}
+
+// Resume starts a paused job
+func (m *Manager) Resume(id string) (JobStatus, error) {
+	return m.setPaused(id, false)
+}
+
+func (m *Manager) setPaused(id string, paused bool) (JobStatus, error) {
+
+	j, err := m.get(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+
+	j.lock.Lock()
+	changed := j.job.Paused != paused
+	j.job.Paused = paused
+	job := j.job
+	j.lock.Unlock()
+
+	if !changed {
+		return j.jobStatus(), nil
+	}
+
+	if err := m.save(job); err != nil {
+		return JobStatus{}, err
+	}
+
+	if paused {
+		j.stop()
+	} else {
+		m.start(j)
+	}
+	return j.jobStatus(), nil
+}
+
+// Delete stops a job and removes it
+func (m *Manager) Delete(id string) error {
+
+	m.lock.Lock()
+	j, found := m.jobs[id]
+	delete(m.jobs, id)
+	m.lock.Unlock()
+	if !found {
+		return ErrNotFound
+	}
+
+	j.stop()
+	return m.docs.DeleteDocument(jobsCollection, id)
+}
+
+// Stop stops all jobs. They are started again by the next Load
+func (m *Manager) Stop() {
+
+	m.lock.Lock()
+	jobs := m.jobs
+	m.jobs = make(map[string]*runningJob)
+	m.lock.Unlock()
+
+	for _, j := range jobs {
+		j.stop()
+	}
+}
+
+func (m *Manager) start(j *runningJob) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.stopch != nil {
+		return
+	}
+	j.stopch = make(chan struct{})
+	j.done = make(chan struct{})
+	j.status.State = StateRunning
+	j.status.Started = time.Now().Unix()
+
+	go m.run(j, j.stopch, j.done)
+}
+
+// stop stops the job if it's running, and waits for it to quit
+func (j *runningJob) stop() {
+
+	j.lock.Lock()
+	stopch, done := j.stopch, j.done
+	j.stopch, j.done = nil, nil
+	j.status.State = StatePaused
+	j.lock.Unlock()
+
+	if stopch != nil {
+		close(stopch)
+		<-done
+	}
+}
+
+func (j *runningJob) jobStatus() JobStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return JobStatus{Job: j.job, Status: j.status}
+}
+
+// setState updates the job's status, unless the run it's called from was stopped in the meantime
+func (j *runningJob) setState(stopch <-chan struct{}, state string, err error) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.stopch != stopch {
+		return
+	}
+
+	now := time.Now().Unix()
+	j.status.State = state
+	switch state {
+	case StateRunning:
+		j.status.Started = now
+	case StateRestarting:
+		j.status.Restarts++
+	}
+	if err != nil {
+		j.status.LastError = err.Error()
+		j.status.ErrorTime = now
+	}
+}
+
+// run runs the job's pipeline until the job is stopped, restarting it if its stream ends or fails
+func (m *Manager) run(j *runningJob, stopch <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		j.setState(stopch, StateRunning, nil)
+		err := j.runOnce(stopch)
+
+		select {
+		case <-stopch:
+			return
+		default:
+		}
+
+		if err == nil {
+			err = errors.New("Stream ended")
+		}
+		logging.Error("Job %s (%s) failed, restarting in %s: %s", j.job.Name, j.job.ID, m.delay, err)
+		j.setState(stopch, StateRestarting, err)
+
+		select {
+		case <-time.After(m.delay):
+		case <-stopch:
+			return
+		}
+	}
+}
+
+// runOnce streams the job's pipeline until it ends or the job is stopped. Panics are returned as errors
+func (j *runningJob) runOnce(stopch <-chan struct{}) (err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+
+	j.lock.Lock()
+	query := j.job.Query
+	j.lock.Unlock()
+
+	source, err := query.Eval()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := source.Stream(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case _, ok := <-stream.Events:
+			if !ok {
+				return stream.Err()
+			}
+		case <-stopch:
+			return nil
+		}
+	}
+}
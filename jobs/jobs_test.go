@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/pipeline"
+	"github.com/dvirsky/timedis/query/ast"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockStore records what is put, and hands out a channel per subscription that tests can publish to
+type mockStore struct {
+	lock sync.Mutex
+	evs  []*events.Event
+	subs []chan events.Result
+}
+
+func (m *mockStore) Put(evs ...*events.Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.evs = append(m.evs, evs...)
+	return nil
+}
+
+func (m *mockStore) Get(key string, from, to time.Time) (events.Result, error) {
+	return events.Result{Key: key}, nil
+}
+
+func (m *mockStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ch := make(chan events.Result, 1)
+	m.subs = append(m.subs, ch)
+	return ch, nil
+}
+
+// publish sends a result to the n-th subscription, waiting for it to be made
+func (m *mockStore) publish(n int, res events.Result) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		m.lock.Lock()
+		subs := m.subs
+		m.lock.Unlock()
+		if len(subs) > n {
+			subs[n] <- res
+			return
+		}
+	}
+}
+
+func (m *mockStore) stored() []*events.Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*events.Event(nil), m.evs...)
+}
+
+type mockDocuments struct {
+	lock sync.Mutex
+	docs map[string]map[string][]byte
+}
+
+func (m *mockDocuments) SaveDocument(collection, id string, doc []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.docs[collection] == nil {
+		m.docs[collection] = make(map[string][]byte)
+	}
+	m.docs[collection][id] = doc
+	return nil
+}
+
+func (m *mockDocuments) LoadDocuments(collection string) (map[string][]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string][]byte)
+	for id, doc := range m.docs[collection] {
+		ret[id] = doc
+	}
+	return ret, nil
+}
+
+func (m *mockDocuments) DeleteDocument(collection, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.docs[collection], id)
+	return nil
+}
+
+func (m *mockDocuments) AppendLog(log string, entry []byte, maxLen int) error {
+	return nil
+}
+
+func (m *mockDocuments) ReadLog(log string, n int) ([][]byte, error) {
+	return nil, nil
+}
+
+// waitStored waits for the store to hold n events
+func waitStored(st *mockStore, n int) []*events.Event {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if evs := st.stored(); len(evs) >= n {
+			return evs
+		}
+	}
+	return st.stored()
+}
+
+func TestMaterialize(t *testing.T) {
+
+	st := &mockStore{}
+	pipeline.InitStore(st)
+	docs := &mockDocuments{docs: make(map[string]map[string][]byte)}
+
+	m := NewManager(docs)
+	query := ast.Node{Type: ast.TypeFaucet, Params: map[string]interface{}{"key": "sys.cpu"}}
+
+	_, err := m.Create(Materialize("bad", "", query))
+	assert.Error(t, err)
+	// a job can't store into the key it reads
+	_, err = m.Create(Materialize("loop", "sys.cpu", query))
+	assert.Error(t, err)
+
+	job, err := m.Create(Materialize("cpu", "sys.cpu.copy", query))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, job.ID)
+	assert.Len(t, m.List(), 1)
+
+	st.publish(0, events.Result{Key: "sys.cpu", Records: []events.Record{{Time: time.Unix(1000, 0), Value: 3}}})
+	evs := waitStored(st, 1)
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, "sys.cpu.copy", evs[0].Key)
+		assert.Equal(t, float64(3), evs[0].Value)
+	}
+
+	// jobs survive restarts
+	m.Stop()
+	assert.Len(t, m.List(), 0)
+	m = NewManager(docs)
+	assert.NoError(t, m.Load())
+	jobs := m.List()
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, job, jobs[0].Job)
+	}
+
+	st.publish(1, events.Result{Key: "sys.cpu", Records: []events.Record{{Time: time.Unix(1001, 0), Value: 4}}})
+	assert.Len(t, waitStored(st, 2), 2)
+	m.Stop()
+}
+
+func waitState(m *Manager, id, state string) JobStatus {
+	var st JobStatus
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if st, _ = m.Get(id); st.Status.State == state {
+			break
+		}
+	}
+	return st
+}
+
+func TestJobLifecycle(t *testing.T) {
+
+	st := &mockStore{}
+	pipeline.InitStore(st)
+	docs := &mockDocuments{docs: make(map[string]map[string][]byte)}
+
+	m := NewManager(docs)
+	m.delay = time.Millisecond
+	job, err := m.Create(Job{Name: "cpu", Query: ast.Node{Type: ast.TypeFaucet, Params: map[string]interface{}{"key": "sys.cpu"}}})
+	assert.NoError(t, err)
+
+	status := waitState(m, job.ID, StateRunning)
+	assert.Equal(t, StateRunning, status.Status.State)
+	assert.NotZero(t, status.Status.Started)
+
+	// paused jobs stay paused across restarts
+	status, err = m.Pause(job.ID)
+	assert.NoError(t, err)
+	assert.True(t, status.Paused)
+	assert.Equal(t, StatePaused, status.Status.State)
+
+	m.Stop()
+	m = NewManager(docs)
+	m.delay = time.Millisecond
+	assert.NoError(t, m.Load())
+	status, err = m.Get(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePaused, status.Status.State)
+
+	status, err = m.Resume(job.ID)
+	assert.NoError(t, err)
+	assert.False(t, status.Paused)
+	assert.Equal(t, StateRunning, status.Status.State)
+
+	assert.NoError(t, m.Delete(job.ID))
+	assert.Len(t, m.List(), 0)
+	assert.Len(t, docs.docs[jobsCollection], 0)
+	assert.Equal(t, ErrNotFound, m.Delete(job.ID))
+
+	// without a store the faucet panics, which is recorded as the job's error and the job is restarted
+	pipeline.InitStore(nil)
+	defer pipeline.InitStore(st)
+	job, err = m.Create(job)
+	assert.NoError(t, err)
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status, _ = m.Get(job.ID); status.Status.Restarts > 1 {
+			break
+		}
+	}
+	assert.True(t, status.Status.Restarts > 1)
+	assert.Contains(t, status.Status.LastError, "panic")
+	assert.NotZero(t, status.Status.ErrorTime)
+
+	_, err = m.Pause("nope")
+	assert.Equal(t, ErrNotFound, err)
+	m.Stop()
+}
@@ -0,0 +1,456 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+const (
+	// FillNone only combines events that have a matching event in every upstream
+	FillNone = "none"
+	// FillPrevious combines the events of each timestamp, using the previous value of upstreams with no event there
+	FillPrevious = "previous"
+	// FillZero combines the events of each timestamp, using 0 for upstreams with no event there
+	FillZero = "zero"
+)
+
+// alignment is the set of aligned values from all upstreams, in upstream order
+type alignment struct {
+	Time   time.Time
+	Keys   []string
+	Values []float64
+}
+
+// aligner matches events from several upstreams by their timestamps. It expects them in time order, as
+// mergeUpstreams streams them, so it only has to hold on to events until the other upstreams pass them
+type aligner struct {
+	tolerance time.Duration
+	fill      string
+	// pending holds unmatched events per upstream, in arrival order
+	pending [][]*events.Event
+	// last holds the last event seen per upstream
+	last []*events.Event
+	// ended marks the upstreams that ended, which can't match anything anymore
+	ended []bool
+
+	// groups buffers the events of each timestamp when filling, in time order, until they can be filled
+	groups []*group
+	// prev holds the last event combined per upstream, which FillPrevious fills with
+	prev []*events.Event
+}
+
+// group is the events of all upstreams at a timestamp, within the tolerance
+type group struct {
+	time time.Time
+	evs  []*events.Event
+}
+
+func newAligner(n int, tolerance time.Duration, fill string) (*aligner, error) {
+
+	switch fill {
+	case "":
+		fill = FillNone
+	case FillNone, FillPrevious, FillZero:
+	default:
+		return nil, fmt.Errorf("Invalid fill policy '%s'", fill)
+	}
+
+	if tolerance < 0 {
+		return nil, fmt.Errorf("Invalid tolerance %s", tolerance)
+	}
+
+	return &aligner{
+		tolerance: tolerance,
+		fill:      fill,
+		pending:   make([][]*events.Event, n),
+		last:      make([]*events.Event, n),
+		ended:     make([]bool, n),
+		prev:      make([]*events.Event, n),
+	}, nil
+}
+
+func (a *aligner) within(t1, t2 time.Time) bool {
+	d := t1.Sub(t2)
+	if d < 0 {
+		d = -d
+	}
+	return d <= a.tolerance
+}
+
+// push adds an event from upstream idx, and returns the alignments it completes, in time order
+func (a *aligner) push(idx int, ev *events.Event) []alignment {
+
+	a.last[idx] = ev
+
+	if a.fill == FillNone {
+		ret, ok := a.match(idx, ev)
+		a.prune()
+		if ok {
+			return []alignment{ret}
+		}
+		return nil
+	}
+
+	a.group(idx, ev)
+	return a.release()
+}
+
+// end marks upstream idx as ended, and returns the alignments that no longer wait for it
+func (a *aligner) end(idx int) []alignment {
+
+	a.ended[idx] = true
+
+	if a.fill == FillNone {
+		a.prune()
+		return nil
+	}
+	return a.release()
+}
+
+// passed returns whether upstream i can no longer send an event within the tolerance of t
+func (a *aligner) passed(i int, t time.Time) bool {
+	return a.ended[i] || (a.last[i] != nil && a.last[i].Time.Sub(t) > a.tolerance)
+}
+
+func (a *aligner) newAlignment(t time.Time) alignment {
+	return alignment{
+		Time:   t,
+		Keys:   make([]string, len(a.last)),
+		Values: make([]float64, len(a.last)),
+	}
+}
+
+// group adds an event to the closest buffered timestamp within the tolerance that has no event of its upstream yet,
+// or buffers a new timestamp for it
+func (a *aligner) group(idx int, ev *events.Event) {
+
+	var best *group
+	var bestDist time.Duration
+	for _, g := range a.groups {
+		if g.evs[idx] != nil || !a.within(g.time, ev.Time) {
+			continue
+		}
+		d := g.time.Sub(ev.Time)
+		if d < 0 {
+			d = -d
+		}
+		if best == nil || d < bestDist {
+			best, bestDist = g, d
+		}
+	}
+
+	if best == nil {
+		best = &group{time: ev.Time, evs: make([]*events.Event, len(a.last))}
+		i := len(a.groups)
+		for i > 0 && a.groups[i-1].time.After(ev.Time) {
+			i--
+		}
+		a.groups = append(a.groups, nil)
+		copy(a.groups[i+1:], a.groups[i:])
+		a.groups[i] = best
+	}
+	best.evs[idx] = ev
+}
+
+// ready returns whether a buffered timestamp can be filled: either it has an event from every upstream, or all the
+// upstreams missing from it have moved on past the tolerance or ended, so they can no longer match it
+func (a *aligner) ready(g *group) bool {
+	for i, ev := range g.evs {
+		if ev == nil && !a.passed(i, g.time) {
+			return false
+		}
+	}
+	return true
+}
+
+// release fills the ready timestamps at the head of the buffer. Incomplete ones wait for as long as it takes
+func (a *aligner) release() []alignment {
+
+	var ret []alignment
+	for len(a.groups) > 0 {
+		g := a.groups[0]
+		if !a.ready(g) {
+			break
+		}
+		a.groups = a.groups[1:]
+		if aligned, ok := a.fillGroup(g); ok {
+			ret = append(ret, aligned)
+		}
+	}
+	return ret
+}
+
+// fillGroup combines the events of a timestamp, filling in the upstreams that have none. With FillPrevious, it fails
+// until every upstream has had an event
+func (a *aligner) fillGroup(g *group) (alignment, bool) {
+
+	ret := a.newAlignment(g.time)
+	ok := true
+	for i, ev := range g.evs {
+		if ev != nil {
+			a.prev[i] = ev
+			ret.Keys[i] = ev.Key
+			ret.Values[i] = ev.Value
+			continue
+		}
+
+		switch {
+		case a.fill == FillPrevious && a.prev[i] == nil:
+			ok = false
+		case a.fill == FillPrevious:
+			ret.Keys[i] = a.prev[i].Key
+			ret.Values[i] = a.prev[i].Value
+		case a.last[i] != nil:
+			ret.Keys[i] = a.last[i].Key
+		}
+	}
+	return ret, ok
+}
+
+// match looks for an event within the tolerance in each of the other upstreams. If all are found, they are consumed
+// along with any older unmatched events, which can no longer be matched by events arriving in order
+func (a *aligner) match(idx int, ev *events.Event) (alignment, bool) {
+
+	ret := a.newAlignment(ev.Time)
+	matches := make([]int, len(a.pending))
+
+	for i, pending := range a.pending {
+		if i == idx {
+			ret.Keys[i] = ev.Key
+			ret.Values[i] = ev.Value
+			continue
+		}
+
+		matches[i] = -1
+		var best time.Duration
+		for j, p := range pending {
+			if !a.within(p.Time, ev.Time) {
+				continue
+			}
+			d := p.Time.Sub(ev.Time)
+			if d < 0 {
+				d = -d
+			}
+			if matches[i] == -1 || d < best {
+				matches[i], best = j, d
+			}
+		}
+
+		if matches[i] == -1 {
+			a.pending[idx] = append(a.pending[idx], ev)
+			return ret, false
+		}
+		ret.Keys[i] = pending[matches[i]].Key
+		ret.Values[i] = pending[matches[i]].Value
+	}
+
+	for i := range a.pending {
+		if i == idx {
+			a.pending[i] = dropUntil(a.pending[i], ev.Time)
+		} else {
+			a.pending[i] = a.pending[i][matches[i]+1:]
+		}
+	}
+
+	return ret, true
+}
+
+// prune drops the pending events that can no longer be matched, because an upstream has passed them without
+// leaving a match of its own behind
+func (a *aligner) prune() {
+
+	for i, pending := range a.pending {
+		kept := pending[:0]
+		for _, p := range pending {
+			if !a.dead(i, p) {
+				kept = append(kept, p)
+			}
+		}
+		a.pending[i] = kept
+	}
+}
+
+func (a *aligner) dead(idx int, ev *events.Event) bool {
+
+	for i := range a.pending {
+		if i == idx || !a.passed(i, ev.Time) {
+			continue
+		}
+		matchable := false
+		for _, p := range a.pending[i] {
+			if a.within(p.Time, ev.Time) {
+				matchable = true
+				break
+			}
+		}
+		if !matchable {
+			return true
+		}
+	}
+	return false
+}
+
+// dropUntil removes pending events up to t
+func dropUntil(pending []*events.Event, t time.Time) []*events.Event {
+	for len(pending) > 0 && !pending[0].Time.After(t) {
+		pending = pending[1:]
+	}
+	return pending
+}
+
+// indexedEvent is an event along with the index of the upstream it came from. A nil event marks the end of the
+// upstream
+type indexedEvent struct {
+	idx int
+	ev  *events.Event
+}
+
+// mergeUpstreams streams all upstreams into one channel of indexed events in time order, and closes it once all of
+// them end. Each upstream's end is marked by an event-less indexedEvent. An event is passed on once no other upstream
+// can send an earlier one, as they stream in time order, so an upstream that is ahead of the others isn't read until
+// they catch up. If one of them fails, the others are canceled. The returned function gives the upstream error once
+// the channel is closed
+func mergeUpstreams(ctx context.Context, upstream []Source) (<-chan indexedEvent, func() error, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	streams := make([]*Stream, 0, len(upstream))
+	for _, u := range upstream {
+		s, err := u.Stream(ctx)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		streams = append(streams, s)
+	}
+
+	// each upstream is read by its own goroutine, which waits for its event to be passed on before reading the next
+	in := make(chan indexedEvent)
+	next := make([]chan struct{}, len(streams))
+	for i, s := range streams {
+		next[i] = make(chan struct{}, 1)
+		go func(idx int, s *Stream) {
+			for ev := range s.Events {
+				select {
+				case in <- indexedEvent{idx, ev}:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case <-next[idx]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case in <- indexedEvent{idx: idx}:
+			case <-ctx.Done():
+			}
+		}(i, s)
+	}
+
+	ret := make(chan indexedEvent)
+	// err is only set by the merging goroutine before it closes ret
+	var err error
+
+	go func() {
+		defer close(ret)
+		defer cancel()
+
+		m := newMerger(len(streams))
+		for !m.done() {
+			for i := m.next(); i != -1; i = m.next() {
+				select {
+				case ret <- indexedEvent{i, m.heads[i]}:
+				case <-ctx.Done():
+					return
+				}
+				m.heads[i] = nil
+				next[i] <- struct{}{}
+			}
+
+			select {
+			case iev := <-in:
+				if iev.ev != nil {
+					m.add(iev.idx, iev.ev)
+					continue
+				}
+				if err = streams[iev.idx].Err(); err != nil {
+					return
+				}
+				m.ended[iev.idx] = true
+				select {
+				case ret <- iev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ret, func() error {
+		return err
+	}, nil
+}
+
+// merger tracks the next event of each upstream of mergeUpstreams, and which of them can be passed on
+type merger struct {
+	heads []*events.Event
+	// last is the time of the last event read per upstream, which the upstream's next event can't be before
+	last  []time.Time
+	seen  []bool
+	ended []bool
+}
+
+func newMerger(n int) *merger {
+	return &merger{
+		heads: make([]*events.Event, n),
+		last:  make([]time.Time, n),
+		seen:  make([]bool, n),
+		ended: make([]bool, n),
+	}
+}
+
+func (m *merger) add(idx int, ev *events.Event) {
+	m.heads[idx] = ev
+	m.last[idx] = ev.Time
+	m.seen[idx] = true
+}
+
+// next returns the upstream whose event goes next, or -1 if it isn't known yet
+func (m *merger) next() int {
+
+	ret := -1
+	for i, ev := range m.heads {
+		if ev != nil && (ret == -1 || ev.Time.Before(m.heads[ret].Time)) {
+			ret = i
+		}
+	}
+	if ret == -1 {
+		return -1
+	}
+
+	// an upstream we're still waiting on may send an earlier event, unless it has already passed this one
+	t := m.heads[ret].Time
+	for i := range m.heads {
+		if m.heads[i] == nil && !m.ended[i] && (!m.seen[i] || t.After(m.last[i])) {
+			return -1
+		}
+	}
+	return ret
+}
+
+// done returns whether all upstreams ended and all their events were passed on
+func (m *merger) done() bool {
+	for i, ended := range m.ended {
+		if !ended || m.heads[i] != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+const (
+	AnomalyZScore   = "zscore"
+	AnomalyMAD      = "mad"
+	AnomalySeasonal = "seasonal"
+
+	// AnnotationScore and AnnotationAnomaly are the annotations the anomaly operator adds to events
+	AnnotationScore   = "score"
+	AnnotationAnomaly = "anomaly"
+
+	// maxScore caps anomaly scores, since a flat baseline makes any deviation infinitely anomalous
+	maxScore = 1e9
+
+	// madScale makes MAD scores comparable to z-scores for normally distributed data
+	madScale = 0.6745
+)
+
+// Anomaly scores each event against a baseline of the events before it, and passes it on annotated with the score
+// and whether its absolute value exceeds Threshold. Events are not flagged until the baseline is full.
+//
+// The methods are:
+//   - zscore: distance from the mean of the last Window values, in standard deviations
+//   - mad: distance from the median of the last Window values, in median absolute deviations, which is robust
+//     to the outliers it's looking for
+//   - seasonal: z-score against the values at the same point of the last Window cycles of Season samples
+type Anomaly struct {
+	Method    string  `mapstructure:"method"`
+	Window    int     `mapstructure:"window"`
+	Threshold float64 `mapstructure:"threshold"`
+	Season    int     `mapstructure:"season"`
+	upstream  Source
+}
+
+func NewAnomaly(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Anomaly can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &Anomaly{Method: AnomalyZScore, Window: 30, Threshold: 3}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	switch ret.Method {
+	case AnomalyZScore, AnomalyMAD:
+		if ret.Window < 2 {
+			return nil, fmt.Errorf("Invalid anomaly window %d", ret.Window)
+		}
+	case AnomalySeasonal:
+		if ret.Season < 2 {
+			return nil, fmt.Errorf("Invalid anomaly season %d", ret.Season)
+		}
+		if ret.Window < 2 {
+			return nil, fmt.Errorf("Invalid anomaly window %d, need at least 2 seasons", ret.Window)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid anomaly method '%s'", ret.Method)
+	}
+
+	if ret.Threshold <= 0 {
+		return nil, fmt.Errorf("Invalid anomaly threshold %v", ret.Threshold)
+	}
+
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+// rollingWindow holds the last values of a series, up to its size
+type rollingWindow struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newRollingWindow(size int) *rollingWindow {
+	return &rollingWindow{values: make([]float64, size)}
+}
+
+func (w *rollingWindow) push(v float64) {
+	w.values[w.next] = v
+	if w.next = (w.next + 1) % len(w.values); w.next == 0 {
+		w.full = true
+	}
+}
+
+func (w *rollingWindow) get() []float64 {
+	if w.full {
+		return w.values
+	}
+	return w.values[:w.next]
+}
+
+func meanStd(vals []float64) (mean, std float64) {
+	for _, v := range vals {
+		mean += v
+	}
+	mean /= float64(len(vals))
+
+	for _, v := range vals {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(vals)))
+}
+
+func median(vals []float64) float64 {
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// score divides a deviation by a spread, capping it for flat baselines
+func score(deviation, spread float64) float64 {
+	if deviation == 0 {
+		return 0
+	}
+	if spread == 0 {
+		return math.Copysign(maxScore, deviation)
+	}
+	return math.Max(-maxScore, math.Min(maxScore, deviation/spread))
+}
+
+func zScore(vals []float64, v float64) float64 {
+	mean, std := meanStd(vals)
+	return score(v-mean, std)
+}
+
+func madScore(vals []float64, v float64) float64 {
+	med := median(vals)
+	deviations := make([]float64, len(vals))
+	for i, x := range vals {
+		deviations[i] = math.Abs(x - med)
+	}
+	return score(madScale*(v-med), median(deviations))
+}
+
+func (a *Anomaly) Stream(ctx context.Context) (*Stream, error) {
+
+	// the seasonal method keeps a window of past cycles per point in the cycle
+	numWindows, windowSize := 1, a.Window
+	if a.Method == AnomalySeasonal {
+		numWindows = a.Season
+	}
+	windows := make([]*rollingWindow, numWindows)
+	for i := range windows {
+		windows[i] = newRollingWindow(windowSize)
+	}
+	n := 0
+
+	return mapStream(ctx, a.upstream, func(ev *events.Event) (*events.Event, bool) {
+
+		w := windows[n%numWindows]
+		n++
+
+		s := 0.0
+		if w.full {
+			switch a.Method {
+			case AnomalyMAD:
+				s = madScore(w.get(), ev.Value)
+			default:
+				s = zScore(w.get(), ev.Value)
+			}
+		}
+		w.push(ev.Value)
+
+		return ev.Clone().
+			Annotate(AnnotationScore, s).
+			Annotate(AnnotationAnomaly, math.Abs(s) > a.Threshold), true
+	})
+}
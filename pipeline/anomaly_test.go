@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func flagged(evs []*events.Event) []bool {
+	ret := make([]bool, 0, len(evs))
+	for _, ev := range evs {
+		ret = append(ret, ev.Annotations[AnnotationAnomaly].(bool))
+	}
+	return ret
+}
+
+func TestAnomaly(t *testing.T) {
+
+	src := series("foo", 10, 11, 9, 10, 11, 9, 10, 50, 10)
+
+	a, err := NewAnomaly(map[string]interface{}{"window": 4}, []Source{src})
+	assert.NoError(t, err)
+	evs := collect(t, a)
+	assert.Len(t, evs, 9)
+	assert.Equal(t, []bool{false, false, false, false, false, false, false, true, false}, flagged(evs))
+
+	// the original event is passed on, annotated
+	assert.Equal(t, float64(50), evs[7].Value)
+	assert.True(t, evs[7].Annotations[AnnotationScore].(float64) > 3)
+	assert.Nil(t, src[7].Annotations)
+
+	b, err := json.Marshal(evs[7])
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"anomaly":true`)
+
+	a, err = NewAnomaly(map[string]interface{}{"window": 4, "method": "mad"}, []Source{src})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false, false, false, false, false, true, false}, flagged(collect(t, a)))
+
+	// a spike that happens every cycle is not an anomaly with the seasonal method, but a missing one is
+	cyclic := series("foo", 1, 1, 9, 1, 1, 9, 1, 1, 9, 1, 1, 1)
+	a, err = NewAnomaly(map[string]interface{}{"method": "seasonal", "season": 3, "window": 2}, []Source{cyclic})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false, false, false, false, false, false, false, false, false, true},
+		flagged(collect(t, a)))
+
+	for _, p := range []map[string]interface{}{
+		{"method": "magic"},
+		{"window": 1},
+		{"method": "seasonal"},
+		{"threshold": 0},
+	} {
+		_, err := NewAnomaly(p, []Source{src})
+		assert.Error(t, err, "%v", p)
+	}
+}
@@ -0,0 +1,171 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+)
+
+// arithmeticOp combines aligned values into one. It returns false if the values can't be combined (e.g. division by 0)
+type arithmeticOp struct {
+	symbol string
+	apply  func(vals []float64) (float64, bool)
+}
+
+var (
+	opSum = arithmeticOp{"+", func(vals []float64) (float64, bool) {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			ret += v
+		}
+		return ret, true
+	}}
+
+	opDifference = arithmeticOp{"-", func(vals []float64) (float64, bool) {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			ret -= v
+		}
+		return ret, true
+	}}
+
+	opProduct = arithmeticOp{"*", func(vals []float64) (float64, bool) {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			ret *= v
+		}
+		return ret, true
+	}}
+
+	opRatio = arithmeticOp{"/", func(vals []float64) (float64, bool) {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			if v == 0 {
+				return 0, false
+			}
+			ret /= v
+		}
+		return ret, true
+	}}
+)
+
+// Arithmetic combines the values of several upstreams, aligned by timestamp, into one series.
+// Difference and ratio apply to the first upstream with the rest, left to right
+type Arithmetic struct {
+	// Key is the key of the output events. If not set, it's the upstream keys joined by the operator
+	Key string `mapstructure:"key"`
+	// Tolerance is how far apart, in seconds, events can be and still be considered aligned
+	Tolerance float64 `mapstructure:"tolerance"`
+	// Fill is the policy for upstreams with no aligned event - none, previous or zero
+	Fill string `mapstructure:"fill"`
+
+	op       arithmeticOp
+	upstream []Source
+}
+
+func newArithmetic(op arithmeticOp, params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) < 2 {
+		return nil, fmt.Errorf("Arithmetic operator %s needs at least 2 upstreams, has %d", op.symbol, len(upstream))
+	}
+
+	ret := &Arithmetic{op: op, upstream: upstream}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	// validate the alignment params early
+	if _, err := ret.newAligner(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func NewSum(params map[string]interface{}, upstream []Source) (Source, error) {
+	return newArithmetic(opSum, params, upstream)
+}
+
+func NewDifference(params map[string]interface{}, upstream []Source) (Source, error) {
+	return newArithmetic(opDifference, params, upstream)
+}
+
+func NewProduct(params map[string]interface{}, upstream []Source) (Source, error) {
+	return newArithmetic(opProduct, params, upstream)
+}
+
+func NewRatio(params map[string]interface{}, upstream []Source) (Source, error) {
+	return newArithmetic(opRatio, params, upstream)
+}
+
+func (a *Arithmetic) newAligner() (*aligner, error) {
+	return newAligner(len(a.upstream), seconds(a.Tolerance), a.Fill)
+}
+
+func (a *Arithmetic) Stream(ctx context.Context) (*Stream, error) {
+
+	al, err := a.newAligner()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	merged, mergeErr, err := mergeUpstreams(ctx, a.upstream)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		for iev := range merged {
+			var aligned []alignment
+			if iev.ev == nil {
+				aligned = al.end(iev.idx)
+			} else {
+				aligned = al.push(iev.idx, iev.ev)
+			}
+			if !a.send(ctx, ret, aligned) {
+				logging.Debug("Stream canceled by downstream")
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		err := mergeErr()
+		if err == nil {
+			err = ctx.Err()
+		}
+		ret.end(err)
+	}()
+
+	return ret, nil
+}
+
+// send computes and sends the events of the alignments, returning false if the stream was canceled
+func (a *Arithmetic) send(ctx context.Context, ret *Stream, alignments []alignment) bool {
+
+	for _, aligned := range alignments {
+		val, ok := a.op.apply(aligned.Values)
+		if !ok {
+			continue
+		}
+
+		key := a.Key
+		if key == "" {
+			key = strings.Join(aligned.Keys, a.op.symbol)
+		}
+
+		if !ret.send(ctx, events.NewEvent(key, aligned.Time, val)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAligner(t *testing.T) {
+
+	ev := func(key string, sec int64, val float64) *events.Event {
+		return events.NewEvent(key, time.Unix(sec, 0), val)
+	}
+
+	al, err := newAligner(2, time.Second, FillNone)
+	assert.NoError(t, err)
+
+	assert.Empty(t, al.push(0, ev("a", 10, 1)))
+	assert.Empty(t, al.push(0, ev("a", 20, 2)))
+
+	// matches the second event of a within the tolerance, dropping the first
+	aligned := al.push(1, ev("b", 21, 5))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{2, 5}, aligned[0].Values)
+		assert.Equal(t, []string{"a", "b"}, aligned[0].Keys)
+	}
+	assert.Len(t, al.pending[0], 0)
+
+	// filled timestamps wait until every upstream has passed them
+	al, _ = newAligner(2, 0, FillPrevious)
+	assert.Empty(t, al.push(0, ev("a", 10, 1)))
+	aligned = al.push(1, ev("b", 10, 2))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{1, 2}, aligned[0].Values)
+	}
+	assert.Empty(t, al.push(0, ev("a", 20, 3)))
+	aligned = al.push(1, ev("b", 30, 4))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{3, 2}, aligned[0].Values)
+		assert.Equal(t, time.Unix(20, 0), aligned[0].Time)
+	}
+	aligned = al.end(0)
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{3, 4}, aligned[0].Values)
+	}
+
+	al, _ = newAligner(2, 0, FillZero)
+	assert.Empty(t, al.push(0, ev("a", 10, 1)))
+	aligned = al.push(1, ev("b", 12, 2))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{1, 0}, aligned[0].Values)
+		assert.Equal(t, []string{"a", "b"}, aligned[0].Keys)
+	}
+	aligned = al.push(0, ev("a", 11, 3))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{3, 0}, aligned[0].Values)
+	}
+	aligned = al.push(0, ev("a", 12, 4))
+	if assert.Len(t, aligned, 1) {
+		assert.Equal(t, []float64{4, 2}, aligned[0].Values)
+	}
+	assert.Empty(t, al.groups)
+
+	_, err = newAligner(2, 0, "bogus")
+	assert.Error(t, err)
+}
+
+func TestArithmetic(t *testing.T) {
+
+	user := series("cpu.user", 1, 2, 3)
+	kernel := series("cpu.kernel", 10, 20, 30)
+
+	s, err := NewSum(nil, []Source{user, kernel})
+	assert.NoError(t, err)
+	evs := collect(t, s)
+	assert.Equal(t, []float64{11, 22, 33}, values(evs))
+	assert.Equal(t, "cpu.user+cpu.kernel", evs[0].Key)
+
+	s, err = NewRatio(map[string]interface{}{"key": "ratio"}, []Source{kernel, user})
+	assert.NoError(t, err)
+	evs = collect(t, s)
+	assert.Equal(t, []float64{10, 10, 10}, values(evs))
+	assert.Equal(t, "ratio", evs[0].Key)
+
+	// division by zero is skipped
+	s, _ = NewRatio(nil, []Source{user, series("zero", 0, 1, 0)})
+	assert.Equal(t, []float64{2}, values(collect(t, s)))
+
+	// filled events are sent once per timestamp
+	gappy := sliceSource{series("cpu.kernel", 10)[0], series("cpu.kernel", 0, 0, 30)[2]}
+	s, _ = NewSum(map[string]interface{}{"fill": FillZero}, []Source{user, kernel})
+	assert.Equal(t, []float64{11, 22, 33}, values(collect(t, s)))
+	s, _ = NewSum(map[string]interface{}{"fill": FillZero}, []Source{user, gappy})
+	assert.Equal(t, []float64{11, 2, 33}, values(collect(t, s)))
+	s, _ = NewSum(map[string]interface{}{"fill": FillPrevious}, []Source{user, kernel})
+	assert.Equal(t, []float64{11, 22, 33}, values(collect(t, s)))
+	s, _ = NewSum(map[string]interface{}{"fill": FillPrevious}, []Source{user, gappy})
+	assert.Equal(t, []float64{11, 12, 33}, values(collect(t, s)))
+	s, _ = NewSum(map[string]interface{}{"fill": FillPrevious}, []Source{series("cpu.user", 1, 2, 3, 4), gappy})
+	assert.Equal(t, []float64{11, 12, 33, 34}, values(collect(t, s)))
+
+	// long series are aligned in full, whatever the order their events arrive in
+	long := make([]float64, 3600)
+	for i := range long {
+		long[i] = 1
+	}
+	for _, fill := range []string{FillNone, FillPrevious, FillZero} {
+		s, _ = NewSum(map[string]interface{}{"fill": fill}, []Source{series("a", long...), series("b", long...)})
+		evs = collect(t, s)
+		assert.Len(t, evs, len(long), fill)
+		for i, ev := range evs {
+			if !assert.Equal(t, 2.0, ev.Value, fill) || !assert.Equal(t, int64(1000+i), ev.Time.Unix(), fill) {
+				break
+			}
+		}
+	}
+
+	// the aligner doesn't hold on to unmatched events other upstreams have passed
+	al, _ := newAligner(2, 0, FillNone)
+	for i := int64(0); i < 3600; i++ {
+		al.push(0, events.NewEvent("a", time.Unix(i, 0), 1))
+		al.push(1, events.NewEvent("b", time.Unix(i, 500), 1))
+	}
+	assert.Len(t, al.pending[0], 0)
+	assert.Len(t, al.pending[1], 1)
+
+	_, err = NewDifference(nil, []Source{user})
+	assert.Error(t, err)
+	_, err = NewProduct(map[string]interface{}{"fill": "nope"}, []Source{user, kernel})
+	assert.Error(t, err)
+}
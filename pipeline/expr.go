@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/pipeline/expr"
+)
+
+// Expr evaluates a user expression, such as "(a - b) / a * 100" or "abs(x) > 3 ? 1 : 0", over the values of its
+// upstreams aligned by timestamp like in arithmetic operators. Results that aren't finite numbers, e.g. after a
+// division by 0, are dropped
+type Expr struct {
+	Expression string `mapstructure:"expr"`
+	// Vars names the upstreams in the expression, in order. Defaults to x for a single upstream, or a, b, c...
+	Vars []string `mapstructure:"vars"`
+	// Key is the key of the output events. If not set, it's the upstream keys joined by commas
+	Key string `mapstructure:"key"`
+	// Tolerance is how far apart, in seconds, events can be and still be considered aligned
+	Tolerance float64 `mapstructure:"tolerance"`
+	// Fill is the policy for upstreams with no aligned event - none, previous or zero
+	Fill string `mapstructure:"fill"`
+
+	compiled *expr.Expr
+	upstream []Source
+}
+
+// defaultVars returns the default variable names for n upstreams
+func defaultVars(n int) []string {
+	if n == 1 {
+		return []string{"x"}
+	}
+	ret := make([]string, n)
+	for i := range ret {
+		ret[i] = string(rune('a' + i))
+	}
+	return ret
+}
+
+func NewExpr(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) == 0 {
+		return nil, errors.New("Expr needs at least 1 upstream")
+	}
+	if len(upstream) > 26 {
+		return nil, fmt.Errorf("Expr supports up to 26 upstreams, has %d", len(upstream))
+	}
+
+	ret := &Expr{upstream: upstream}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.Expression == "" {
+		return nil, errors.New("No expression provided for expr")
+	}
+	if ret.Vars == nil {
+		ret.Vars = defaultVars(len(upstream))
+	}
+	if len(ret.Vars) != len(upstream) {
+		return nil, fmt.Errorf("Expr has %d vars for %d upstreams", len(ret.Vars), len(upstream))
+	}
+
+	var err error
+	if ret.compiled, err = expr.Compile(ret.Expression, ret.Vars); err != nil {
+		return nil, err
+	}
+
+	// validate the alignment params early
+	if _, err := ret.newAligner(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (e *Expr) newAligner() (*aligner, error) {
+	return newAligner(len(e.upstream), seconds(e.Tolerance), e.Fill)
+}
+
+func (e *Expr) Stream(ctx context.Context) (*Stream, error) {
+
+	al, err := e.newAligner()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	merged, mergeErr, err := mergeUpstreams(ctx, e.upstream)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		for iev := range merged {
+			var aligned []alignment
+			if iev.ev == nil {
+				aligned = al.end(iev.idx)
+			} else {
+				aligned = al.push(iev.idx, iev.ev)
+			}
+			if !e.send(ctx, ret, aligned) {
+				logging.Debug("Stream canceled by downstream")
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		err := mergeErr()
+		if err == nil {
+			err = ctx.Err()
+		}
+		ret.end(err)
+	}()
+
+	return ret, nil
+}
+
+// send computes and sends the events of the alignments, returning false if the stream was canceled
+func (e *Expr) send(ctx context.Context, ret *Stream, alignments []alignment) bool {
+
+	for _, aligned := range alignments {
+		val := e.compiled.Eval(aligned.Values)
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+
+		key := e.Key
+		if key == "" {
+			key = strings.Join(aligned.Keys, ",")
+		}
+
+		if !ret.send(ctx, events.NewEvent(key, aligned.Time, val)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+// Package expr compiles arithmetic expressions over named float variables, for pipeline nodes that let users write
+// their own math. Expressions can't do anything but compute a number - there are no assignments, loops or calls to
+// anything but a fixed set of math functions - and they are fully validated when compiled.
+//
+// The syntax is C like:
+//
+//	(a - b) / a * 100
+//	abs(x) > 3 ? 1 : 0
+//	max(a, b) % 60 == 0 && !c
+//
+// Comparisons and logical operators evaluate to 1 or 0, and any non zero value is true.
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxLength caps the length of an expression's source
+	MaxLength = 1000
+	// MaxDepth caps the nesting of an expression, so compiling and evaluating it can't blow the stack
+	MaxDepth = 64
+)
+
+// Expr is a compiled expression
+type Expr struct {
+	src  string
+	eval evalFunc
+}
+
+type evalFunc func(vars []float64) float64
+
+// Compile parses an expression, resolving its variables to their index in vars. Unknown variables or functions,
+// and functions called with the wrong number of arguments, are compile errors
+func Compile(src string, vars []string) (*Expr, error) {
+
+	if len(src) > MaxLength {
+		return nil, fmt.Errorf("Expression is too long, max %d characters", MaxLength)
+	}
+
+	idx := make(map[string]int, len(vars))
+	for i, v := range vars {
+		if !isIdent(v) {
+			return nil, fmt.Errorf("Invalid variable name '%s'", v)
+		}
+		if _, found := functions[v]; found {
+			return nil, fmt.Errorf("Variable '%s' shadows a function", v)
+		}
+		if _, found := idx[v]; found {
+			return nil, fmt.Errorf("Duplicate variable '%s'", v)
+		}
+		idx[v] = i
+	}
+
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{toks: toks, vars: idx}
+	eval, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+
+	return &Expr{src: src, eval: eval}, nil
+}
+
+// Eval evaluates the expression with the values of its variables, in the order they were compiled with
+func (e *Expr) Eval(vars []float64) float64 {
+	return e.eval(vars)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type function struct {
+	// arity is the number of arguments, or -1 for one or more
+	arity int
+	call  func(args []float64) float64
+}
+
+func unary(f func(float64) float64) function {
+	return function{1, func(args []float64) float64 { return f(args[0]) }}
+}
+
+func binary(f func(float64, float64) float64) function {
+	return function{2, func(args []float64) float64 { return f(args[0], args[1]) }}
+}
+
+func fold(f func(float64, float64) float64) function {
+	return function{-1, func(args []float64) float64 {
+		ret := args[0]
+		for _, a := range args[1:] {
+			ret = f(ret, a)
+		}
+		return ret
+	}}
+}
+
+var functions = map[string]function{
+	"abs":   unary(math.Abs),
+	"sqrt":  unary(math.Sqrt),
+	"exp":   unary(math.Exp),
+	"log":   unary(math.Log),
+	"log2":  unary(math.Log2),
+	"log10": unary(math.Log10),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"round": unary(math.Round),
+	"pow":   binary(math.Pow),
+	"min":   fold(math.Min),
+	"max":   fold(math.Max),
+	"clamp": {3, func(args []float64) float64 { return math.Max(args[1], math.Min(args[2], args[0])) }},
+}
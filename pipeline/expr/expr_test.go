@@ -0,0 +1,76 @@
+package expr
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+
+	vars := []string{"a", "b", "x"}
+	vals := []float64{50, 40, -4}
+
+	cases := map[string]float64{
+		"(a - b) / a * 100":         20,
+		"abs(x) > 3 ? 1 : 0":        1,
+		"abs(x) > 5 ? 1 : 0":        0,
+		"1 + 2 * 3":                 7,
+		"(1 + 2) * 3":               9,
+		"10 - 4 - 3":                3,
+		"-x":                        4,
+		"!0 && !!b":                 1,
+		"0 || a == 50":              1,
+		"a % 7":                     1,
+		"max(a, b, x) + min(1, 2)":  51,
+		"pow(2, 10)":                1024,
+		"clamp(x, 0, 10)":           0,
+		"1e2 + .5":                  100.5,
+		"x < 0 ? a : x > 0 ? b : 0": 50,
+	}
+
+	for src, expected := range cases {
+		e, err := Compile(src, vars)
+		if assert.NoError(t, err, src) {
+			assert.Equal(t, expected, e.Eval(vals), src)
+		}
+	}
+
+	e, err := Compile("a / b", vars)
+	assert.NoError(t, err)
+	assert.True(t, math.IsInf(e.Eval([]float64{1, 0, 0}), 1))
+}
+
+func TestCompileErrors(t *testing.T) {
+
+	vars := []string{"a", "b"}
+
+	for _, src := range []string{
+		"",
+		"a +",
+		"(a",
+		"a b",
+		"c * 2",
+		"foo(a)",
+		"abs(a, b)",
+		"max()",
+		"a ? b",
+		"a $ b",
+		"1..2",
+		strings.Repeat("(", MaxDepth+1) + "a" + strings.Repeat(")", MaxDepth+1),
+		strings.Repeat("-", MaxDepth+1) + "a",
+		strings.Repeat("a+", MaxLength),
+	} {
+		_, err := Compile(src, vars)
+		assert.Error(t, err, src)
+	}
+
+	_, err := Compile("a", []string{"abs"})
+	assert.Error(t, err)
+	_, err = Compile("a", []string{"1a"})
+	assert.Error(t, err)
+	_, err = Compile("a + b", []string{"a", "b", "a"})
+	assert.Error(t, err)
+}
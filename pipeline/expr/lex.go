@@ -0,0 +1,106 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// text is the token as written, and pos its offset in the source
+	text string
+	pos  int
+	num  float64
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// operators are all the operator and punctuation tokens, longest first so they're matched greedily
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", ",",
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
+
+func lex(src string) ([]token, error) {
+
+	var ret []token
+	i := 0
+
+outer:
+	for i < len(src) {
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			// exponents, e.g. 1e-3
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && unicode.IsDigit(rune(src[i])) {
+					i++
+				}
+			}
+			num, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid number '%s' at %d", src[start:i], start)
+			}
+			ret = append(ret, token{kind: tokNumber, text: src[start:i], pos: start, num: num})
+
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			ret = append(ret, token{kind: tokIdent, text: src[start:i], pos: start})
+
+		default:
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					ret = append(ret, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					continue outer
+				}
+			}
+			return nil, fmt.Errorf("Unexpected character '%c' at %d", c, i)
+		}
+	}
+
+	return append(ret, token{kind: tokEOF, pos: len(src)}), nil
+}
@@ -0,0 +1,299 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+// parser is a recursive descent parser, compiling the expression to closures as it goes. From the lowest
+// precedence up:
+//
+//	ternary:    or ('?' ternary ':' ternary)?
+//	or:         and ('||' and)*
+//	and:        comparison ('&&' comparison)*
+//	comparison: additive (('==' | '!=' | '<' | '<=' | '>' | '>=') additive)?
+//	additive:   term (('+' | '-') term)*
+//	term:       unary (('*' | '/' | '%') unary)*
+//	unary:      ('-' | '+' | '!') unary | primary
+//	primary:    number | variable | function '(' args ')' | '(' ternary ')'
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+	vars  map[string]int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it's one of the given operators
+func (p *parser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		tok := p.peek()
+		return p.errorf(tok, "expected '%s', got %s", op, tok)
+	}
+	return nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid expression at %d: %s", tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseTernary() (evalFunc, error) {
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxDepth {
+		return nil, p.errorf(p.peek(), "expression nested too deep")
+	}
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v []float64) float64 {
+		if cond(v) != 0 {
+			return then(v)
+		}
+		return els(v)
+	}, nil
+}
+
+func (p *parser) parseOr() (evalFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v []float64) float64 { return boolValue(l(v) != 0 || right(v) != 0) }
+	}
+}
+
+func (p *parser) parseAnd() (evalFunc, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v []float64) float64 { return boolValue(l(v) != 0 && right(v) != 0) }
+	}
+}
+
+var comparisons = map[string]func(a, b float64) bool{
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+func (p *parser) parseComparison() (evalFunc, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	cmp := comparisons[op]
+	return func(v []float64) float64 { return boolValue(cmp(left(v), right(v))) }, nil
+}
+
+var arithmetic = map[string]func(a, b float64) float64{
+	"+": func(a, b float64) float64 { return a + b },
+	"-": func(a, b float64) float64 { return a - b },
+	"*": func(a, b float64) float64 { return a * b },
+	"/": func(a, b float64) float64 { return a / b },
+	"%": math.Mod,
+}
+
+// parseBinary parses a left associative chain of arithmetic operators
+func (p *parser) parseBinary(operand func() (evalFunc, error), ops ...string) (evalFunc, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l, f := left, arithmetic[op]
+		left = func(v []float64) float64 { return f(l(v), right(v)) }
+	}
+}
+
+func (p *parser) parseAdditive() (evalFunc, error) {
+	return p.parseBinary(p.parseTerm, "+", "-")
+}
+
+func (p *parser) parseTerm() (evalFunc, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *parser) parseUnary() (evalFunc, error) {
+
+	op, ok := p.accept("-", "+", "!")
+	if !ok {
+		return p.parsePrimary()
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxDepth {
+		return nil, p.errorf(p.peek(), "expression nested too deep")
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "-":
+		return func(v []float64) float64 { return -operand(v) }, nil
+	case "!":
+		return func(v []float64) float64 { return boolValue(operand(v) == 0) }, nil
+	}
+	return operand, nil
+}
+
+func (p *parser) parsePrimary() (evalFunc, error) {
+
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		num := tok.num
+		return func([]float64) float64 { return num }, nil
+
+	case tokIdent:
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+		i, found := p.vars[tok.text]
+		if !found {
+			return nil, p.errorf(tok, "unknown variable '%s'", tok.text)
+		}
+		return func(v []float64) float64 { return v[i] }, nil
+
+	case tokOp:
+		if tok.text == "(" {
+			inner, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+
+	return nil, p.errorf(tok, "unexpected %s", tok)
+}
+
+// parseCall parses a function's arguments, after its opening parenthesis
+func (p *parser) parseCall(name token) (evalFunc, error) {
+
+	fn, found := functions[name.text]
+	if !found {
+		return nil, p.errorf(name, "unknown function '%s'", name.text)
+	}
+
+	var args []evalFunc
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if fn.arity >= 0 && len(args) != fn.arity {
+		return nil, p.errorf(name, "%s takes %d arguments, got %d", name.text, fn.arity, len(args))
+	}
+	if fn.arity < 0 && len(args) == 0 {
+		return nil, p.errorf(name, "%s takes at least 1 argument", name.text)
+	}
+
+	return func(v []float64) float64 {
+		vals := make([]float64, len(args))
+		for i, arg := range args {
+			vals[i] = arg(v)
+		}
+		return fn.call(vals)
+	}, nil
+}
@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpr(t *testing.T) {
+
+	total := series("mem.total", 100, 200, 400)
+	free := series("mem.free", 50, 50, 100)
+
+	s, err := NewExpr(map[string]interface{}{"expr": "(a - b) / a * 100"}, []Source{total, free})
+	assert.NoError(t, err)
+	evs := collect(t, s)
+	assert.Equal(t, []float64{50, 75, 75}, values(evs))
+	assert.Equal(t, "mem.total,mem.free", evs[0].Key)
+
+	s, err = NewExpr(map[string]interface{}{
+		"expr": "used / total",
+		"vars": []string{"total", "used"},
+		"key":  "mem.used",
+	}, []Source{total, free})
+	assert.NoError(t, err)
+	evs = collect(t, s)
+	assert.Equal(t, []float64{0.5, 0.25, 0.25}, values(evs))
+	assert.Equal(t, "mem.used", evs[0].Key)
+
+	// a single upstream is x, and non finite results are dropped
+	s, err = NewExpr(map[string]interface{}{"expr": "x > 1 ? 1 / (x - 2) : 0"}, []Source{series("v", 1, 2, 3)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0, 1}, values(collect(t, s)))
+
+	_, err = NewExpr(map[string]interface{}{"expr": "a + c"}, []Source{total, free})
+	assert.Error(t, err)
+	_, err = NewExpr(map[string]interface{}{"expr": "a", "vars": []string{"a"}}, []Source{total, free})
+	assert.Error(t, err)
+	_, err = NewExpr(map[string]interface{}{"expr": "a", "vars": []string{"a", "a"}}, []Source{total, free})
+	assert.Error(t, err)
+	_, err = NewExpr(nil, []Source{total})
+	assert.Error(t, err)
+}
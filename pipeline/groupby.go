@@ -0,0 +1,215 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+	stor "github.com/dvirsky/timedis/store"
+)
+
+const (
+	// AnnotationSource is the annotation groupBy tags events with, holding the key of the series they came from
+	AnnotationSource = "source"
+
+	defaultGroupInterval = 10
+	defaultMaxGroups     = 1000
+)
+
+// GroupBy runs a sub-pipeline per key matching Pattern, and merges their outputs into one stream, with each event
+// annotated with the key it originated from. Tags are parts of the keys written by the line protocol, so series
+// can be grouped by tag with a pattern such as sys.net.*.rx.
+//
+// The sub-pipelines are built from a template by the query's AST, so GroupBy can't be created by a plain
+// SourceFactory
+type GroupBy struct {
+	Pattern string `mapstructure:"pattern"`
+	// Interval is how often in seconds we look for new keys matching the pattern. 0 only looks once, so the stream
+	// ends once all the sub-pipelines end
+	Interval float64 `mapstructure:"interval"`
+	// Max caps the number of sub-pipelines
+	Max   int `mapstructure:"max"`
+	build func(key string) (Source, error)
+}
+
+// NewGroupBy creates a GroupBy building each key's sub-pipeline with build
+func NewGroupBy(params map[string]interface{}, build func(key string) (Source, error)) (Source, error) {
+
+	ret := &GroupBy{Interval: defaultGroupInterval, Max: defaultMaxGroups}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.Pattern == "" {
+		return nil, errors.New("No pattern provided for groupBy")
+	}
+	if ret.Interval < 0 {
+		return nil, fmt.Errorf("Invalid groupBy interval %v", ret.Interval)
+	}
+	if ret.Max <= 0 {
+		return nil, fmt.Errorf("Invalid groupBy max %d", ret.Max)
+	}
+
+	ret.build = build
+	return ret, nil
+}
+
+// groups tracks the running sub-pipelines of a groupBy stream
+type groups struct {
+	g      *GroupBy
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan *events.Event
+	wg     sync.WaitGroup
+
+	lock    sync.Mutex
+	started map[string]bool
+	err     error
+}
+
+// start starts the sub-pipelines of keys we haven't seen yet
+func (gs *groups) start(keys []string) error {
+
+	for _, key := range keys {
+		if gs.started[key] {
+			continue
+		}
+		if len(gs.started) >= gs.g.Max {
+			logging.Warning("groupBy %s reached its maximum of %d groups, ignoring %s", gs.g.Pattern, gs.g.Max, key)
+			continue
+		}
+
+		src, err := gs.g.build(key)
+		if err != nil {
+			return err
+		}
+		s, err := src.Stream(gs.ctx)
+		if err != nil {
+			return err
+		}
+
+		gs.started[key] = true
+		gs.wg.Add(1)
+		go gs.forward(key, s)
+	}
+	return nil
+}
+
+// forward passes a sub-pipeline's events on, tagged with its key. If it fails, the whole groupBy fails
+func (gs *groups) forward(key string, s *Stream) {
+	defer gs.wg.Done()
+
+	for ev := range s.Events {
+		select {
+		case gs.out <- ev.Clone().Annotate(AnnotationSource, key):
+		case <-gs.ctx.Done():
+		}
+	}
+
+	if err := s.Err(); err != nil && gs.ctx.Err() == nil {
+		gs.fail(fmt.Errorf("Group %s failed: %s", key, err))
+	}
+}
+
+func (gs *groups) fail(err error) {
+	gs.lock.Lock()
+	if gs.err == nil {
+		gs.err = err
+	}
+	gs.lock.Unlock()
+	gs.cancel()
+}
+
+func (gs *groups) error() error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	return gs.err
+}
+
+// discover periodically starts sub-pipelines for new keys
+func (gs *groups) discover(lister stor.KeyLister) {
+	defer gs.wg.Done()
+
+	ticker := time.NewTicker(seconds(gs.g.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			keys, err := lister.Keys(gs.g.Pattern)
+			if err != nil {
+				logging.Error("Could not list keys matching %s: %s", gs.g.Pattern, err)
+				continue
+			}
+			if err := gs.start(keys); err != nil {
+				gs.fail(err)
+				return
+			}
+		case <-gs.ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *GroupBy) Stream(ctx context.Context) (*Stream, error) {
+
+	lister, ok := store.(stor.KeyLister)
+	if !ok {
+		return nil, errors.New("The store can't list keys for groupBy")
+	}
+
+	keys, err := lister.Keys(g.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	gs := &groups{
+		g:       g,
+		ctx:     ctx,
+		cancel:  cancel,
+		out:     make(chan *events.Event),
+		started: make(map[string]bool),
+	}
+
+	if err := gs.start(keys); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if g.Interval > 0 {
+		gs.wg.Add(1)
+		go gs.discover(lister)
+	}
+
+	go func() {
+		gs.wg.Wait()
+		close(gs.out)
+	}()
+
+	ret := newStream()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		for ev := range gs.out {
+			if !ret.send(ctx, ev) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		err := gs.error()
+		if err == nil {
+			err = ctx.Err()
+		}
+		ret.end(err)
+	}()
+
+	return ret, nil
+}
@@ -0,0 +1,60 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupBy(t *testing.T) {
+
+	st := &memStore{}
+	InitStore(st)
+	defer InitStore(nil)
+	assert.NoError(t, st.Put(series("sys.net.eth0.rx", 1, 2, 3)...))
+	assert.NoError(t, st.Put(series("sys.net.eth1.rx", 10, 20, 30)...))
+	assert.NoError(t, st.Put(series("sys.net.eth0.tx", 5, 5, 5)...))
+
+	build := func(key string) (Source, error) {
+		f, err := NewFaucet(map[string]interface{}{"key": key, "from": 1000, "to": 1010}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewMovingAverage(map[string]interface{}{"window": 2}, []Source{f})
+	}
+
+	g, err := NewGroupBy(map[string]interface{}{"pattern": "sys.net.*.rx", "interval": 0}, build)
+	assert.NoError(t, err)
+
+	res, err := Collect(context.Background(), g, 0)
+	assert.NoError(t, err)
+	byKey := map[string][]float64{}
+	for _, r := range res {
+		for _, rec := range r.Records {
+			byKey[r.Key] = append(byKey[r.Key], rec.Value)
+		}
+	}
+	assert.Equal(t, map[string][]float64{
+		"sys.net.eth0.rx": {1.5, 2.5},
+		"sys.net.eth1.rx": {15, 25},
+	}, byKey)
+
+	// events are tagged with the key of their group
+	for _, ev := range collect(t, g) {
+		assert.Equal(t, ev.Key, ev.Annotations[AnnotationSource])
+	}
+
+	// a failing group fails the whole stream
+	boom := errors.New("boom")
+	g, err = NewGroupBy(map[string]interface{}{"pattern": "sys.net.*", "interval": 0}, func(key string) (Source, error) {
+		return failingSource{series(key, 1), boom}, nil
+	})
+	assert.NoError(t, err)
+	_, err = Collect(context.Background(), g, 0)
+	assert.Error(t, err)
+
+	_, err = NewGroupBy(map[string]interface{}{}, build)
+	assert.Error(t, err)
+}
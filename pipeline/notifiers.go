@@ -0,0 +1,245 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+)
+
+const (
+	// sendAttempts is how many times a webhook is tried before giving up
+	sendAttempts = 3
+	sendBackoff  = 500 * time.Millisecond
+	sendTimeout  = 10 * time.Second
+
+	defaultSMTPAddr = "localhost:25"
+)
+
+// templateData is what sink templates are executed with
+type templateData struct {
+	Notifications []Notification
+	Count         int
+}
+
+// parseTemplate parses an optional sink template, falling back to def if it's empty
+func parseTemplate(name, text, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, ns []Notification) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, templateData{Notifications: ns, Count: len(ns)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WebhookSink POSTs notifications to a URL. By default the body is a JSON object with a notifications array,
+// a Body template can be used to fit other services' formats. Failed requests are retried with backoff
+type WebhookSink struct {
+	URL         string            `mapstructure:"url"`
+	Body        string            `mapstructure:"body"`
+	ContentType string            `mapstructure:"contentType"`
+	Headers     map[string]string `mapstructure:"headers"`
+	body        *template.Template
+	client      *http.Client
+	backoff     time.Duration
+}
+
+func NewWebhookSink(params map[string]interface{}) (Sink, error) {
+
+	ret := &WebhookSink{ContentType: "application/json"}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.URL == "" {
+		return nil, errors.New("No url provided for webhook")
+	}
+
+	var err error
+	if ret.Body != "" {
+		if ret.body, err = parseTemplate("body", ret.Body, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	ret.client = &http.Client{Timeout: sendTimeout}
+	ret.backoff = sendBackoff
+	return ret, nil
+}
+
+func (s *WebhookSink) Send(ns ...Notification) error {
+
+	var body []byte
+	var err error
+	if s.body != nil {
+		body, err = render(s.body, ns)
+	} else {
+		body, err = json.Marshal(map[string]interface{}{"notifications": ns})
+	}
+	if err != nil {
+		return err
+	}
+
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		if err = s.post(body); err == nil {
+			return nil
+		}
+		if attempt == sendAttempts {
+			return err
+		}
+		logging.Warning("Webhook to %s failed, retrying in %s: %s", s.URL, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", s.ContentType)
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+const (
+	defaultSubject = `{{with index .Notifications 0}}{{.Title}}{{end}}{{if gt .Count 1}} (+{{.Count}}){{end}}`
+	defaultMessage = `{{range .Notifications}}{{.}}
+{{end}}`
+)
+
+// EmailSink mails notifications through an SMTP server, by default the local one
+type EmailSink struct {
+	Addr    string   `mapstructure:"addr"`
+	From    string   `mapstructure:"from"`
+	To      []string `mapstructure:"to"`
+	Subject string   `mapstructure:"subject"`
+	Message string   `mapstructure:"message"`
+	subject *template.Template
+	message *template.Template
+	send    func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewEmailSink(params map[string]interface{}) (Sink, error) {
+
+	ret := &EmailSink{Addr: defaultSMTPAddr, From: "timedis@localhost"}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if len(ret.To) == 0 {
+		return nil, errors.New("No recipients provided for email")
+	}
+
+	var err error
+	if ret.subject, err = parseTemplate("subject", ret.Subject, defaultSubject); err != nil {
+		return nil, err
+	}
+	if ret.message, err = parseTemplate("message", ret.Message, defaultMessage); err != nil {
+		return nil, err
+	}
+
+	ret.send = smtp.SendMail
+	return ret, nil
+}
+
+func (s *EmailSink) Send(ns ...Notification) error {
+
+	subject, err := render(s.subject, ns)
+	if err != nil {
+		return err
+	}
+	message, err := render(s.message, ns)
+	if err != nil {
+		return err
+	}
+
+	msg := bytes.NewBuffer(nil)
+	fmt.Fprintf(msg, "From: %s\r\n", headerValue(s.From))
+	fmt.Fprintf(msg, "To: %s\r\n", headerValue(strings.Join(s.To, ", ")))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(string(subject))))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(message)
+
+	return s.send(s.Addr, nil, s.From, s.To, msg.Bytes())
+}
+
+// headerValue folds a value into a single header line, so values like alert names can't end the header and inject
+// headers of their own
+func headerValue(v string) string {
+	return strings.Join(strings.Fields(v), " ")
+}
+
+// ExecSink runs a local command for each send, with the notifications as JSON on its stdin
+type ExecSink struct {
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+	// Timeout is how many seconds the command may run before it's killed
+	Timeout float64 `mapstructure:"timeout"`
+}
+
+func NewExecSink(params map[string]interface{}) (Sink, error) {
+
+	ret := &ExecSink{Timeout: sendTimeout.Seconds()}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.Command == "" {
+		return nil, errors.New("No command provided for exec")
+	}
+	if ret.Timeout <= 0 {
+		return nil, fmt.Errorf("Invalid exec timeout %v", ret.Timeout)
+	}
+	return ret, nil
+}
+
+func (s *ExecSink) Send(ns ...Notification) error {
+
+	b, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seconds(s.Timeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.Command, s.Args...)
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s (%s)", s.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,8 +1,10 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
 	"time"
 
 	"github.com/dvirsky/go-pylog/logging"
@@ -17,14 +19,99 @@ func InitStore(s stor.Store) {
 	store = s
 }
 
+// Source is a node in a query pipeline
 type Source interface {
-	Stream() (<-chan *events.Event, chan<- bool, error)
+	// Stream starts streaming the source's events. Canceling ctx stops it along with all of its upstreams
+	Stream(ctx context.Context) (*Stream, error)
 }
 
 type SourceFactory func(params map[string]interface{}, upstream []Source) (Source, error)
 
-func makeDownstream() (chan *events.Event, chan bool) {
-	return make(chan *events.Event), make(chan bool)
+// Stream is the output of a running source. Events is closed when the stream ends, after which Err tells why
+type Stream struct {
+	Events <-chan *events.Event
+	events chan *events.Event
+	err    error
+	ended  bool
+}
+
+func newStream() *Stream {
+	ch := make(chan *events.Event)
+	return &Stream{Events: ch, events: ch}
+}
+
+// send passes an event downstream, returning false if ctx was canceled first
+func (s *Stream) send(ctx context.Context, ev *events.Event) bool {
+	select {
+	case s.events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// end closes the stream, with the error that ended it if any. Ending it again does nothing
+func (s *Stream) end(err error) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.err = err
+	close(s.events)
+}
+
+// endOnPanic ends the stream with an error if the goroutine feeding it panics, so a bad node fails its query rather
+// than the whole process. It's deferred by the goroutines feeding streams
+func (s *Stream) endOnPanic() {
+	if e := recover(); e != nil {
+		logging.Error("Pipeline panic: %v\n%s", e, debug.Stack())
+		s.end(fmt.Errorf("panic: %v", e))
+	}
+}
+
+// Err returns the error that ended the stream - the context's error if it was canceled, or nil if it simply ran out
+// of events. It may only be called once Events is closed
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// ErrTooManyEvents is returned by Collect when a stream has more events than it may collect
+var ErrTooManyEvents = errors.New("Too many events")
+
+// Collect runs a source to its end and returns its events grouped by key, in the order the keys first appeared.
+// It's meant for bounded queries, since it doesn't return before the stream ends. max caps the number of events,
+// 0 means no limit
+func Collect(ctx context.Context, source Source, max int) ([]events.Result, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := source.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []events.Result{}
+	idx := make(map[string]int)
+	n := 0
+	for ev := range stream.Events {
+		if n++; max > 0 && n > max {
+			return nil, ErrTooManyEvents
+		}
+
+		i, found := idx[ev.Key]
+		if !found {
+			i = len(ret)
+			idx[ev.Key] = i
+			ret = append(ret, events.Result{Key: ev.Key})
+		}
+		ret[i].Records = append(ret[i].Records, ev.Record)
+	}
+
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 type Filter struct {
@@ -48,36 +135,11 @@ func NewFilter(params map[string]interface{}, upstream []Source) (Source, error)
 	return ret, nil
 }
 
-func (f Filter) Stream() (<-chan *events.Event, chan<- bool, error) {
-
-	events, stopch, err := f.upstream.Stream()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	ret, stopret := makeDownstream()
-
-	go func() {
-
-		select {
-		case ev, ok := <-events:
-			if !ok {
-				goto abort
-			}
-			if ev.Record.Value <= f.MaxValue && ev.Record.Value >= f.MinValue {
-				ret <- ev
-			}
-		case <-stopret:
-			goto abort
-
-		}
-	abort:
-		close(ret)
-		stopch <- true
-		return
-	}()
+func (f Filter) Stream(ctx context.Context) (*Stream, error) {
 
-	return ret, stopret, nil
+	return mapStream(ctx, f.upstream, func(ev *events.Event) (*events.Event, bool) {
+		return ev, ev.Value <= f.MaxValue && ev.Value >= f.MinValue
+	})
 }
 
 type MovingAverage struct {
@@ -91,67 +153,59 @@ func decodeParams(params map[string]interface{}, value interface{}) error {
 
 func NewMovingAverage(params map[string]interface{}, upstream []Source) (Source, error) {
 	if len(upstream) != 1 {
-		return nil, errors.New("Filter can have just 1 upstream")
+		return nil, fmt.Errorf("MovingAverage can have just 1 upstream, has %d", len(upstream))
 	}
 
 	ret := &MovingAverage{}
 	if err := decodeParams(params, ret); err != nil {
 		return nil, err
 	}
+	if ret.WindowSize <= 0 {
+		return nil, fmt.Errorf("Invalid moving average window %d", ret.WindowSize)
+	}
 	ret.upstream = upstream[0]
 	return ret, nil
 
 }
 
-func (f *MovingAverage) Stream() (<-chan *events.Event, chan<- bool, error) {
-
-	events, stopch, err := f.upstream.Stream()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	ret, stopret := makeDownstream()
-
-	go func() {
+// Stream emits the exact average of the last WindowSize values, once the window is full
+func (f *MovingAverage) Stream(ctx context.Context) (*Stream, error) {
 
-		var average float64 = 0
-		numSamples := 0
-		for {
-			select {
-			case ev, ok := <-events:
-				if !ok {
-					goto abort
-				}
+	window := make([]float64, f.WindowSize)
+	numSamples := 0
+	var sum float64
 
-				numSamples++
-				if numSamples > f.WindowSize {
-					average -= average / float64(f.WindowSize)
-				}
-				average += ev.Value / float64(f.WindowSize)
-				if numSamples >= f.WindowSize {
-					ev.Value = average
-					ret <- ev
-				}
+	return mapStream(ctx, f.upstream, func(ev *events.Event) (*events.Event, bool) {
 
-			case <-stopret:
-				logging.Warning("Got stop from downstream")
-				goto abort
+		idx := numSamples % f.WindowSize
+		sum += ev.Value - window[idx]
+		window[idx] = ev.Value
+		numSamples++
 
+		// recalculate the sum once per window, so floating point errors don't accumulate
+		if idx == f.WindowSize-1 {
+			sum = 0
+			for _, v := range window {
+				sum += v
 			}
 		}
-	abort:
-		logging.Error("Aborting moving average")
-		close(ret)
-		stopch <- true
-		return
-	}()
 
-	return ret, stopret, nil
+		if numSamples < f.WindowSize {
+			return nil, false
+		}
+		return events.NewEvent(ev.Key, ev.Time, sum/float64(f.WindowSize)), true
+	})
 }
 
+// Faucet streams a key from the store. A live faucet replays the key from From and then streams new events as they
+// are stored. A bounded faucet, with To set, just replays the events between From and To and ends
 type Faucet struct {
-	Key  string `mapstructure:"key"`
-	From int64  `mapstructure:"from"`
+	Key string `mapstructure:"key"`
+	// From and To are either seconds relative to now if they are 0 or negative, or absolute unix times
+	From int64 `mapstructure:"from"`
+	To   int64 `mapstructure:"to"`
+	// hub shares the faucet's live subscription, if set
+	hub *Hub
 }
 
 func NewFaucet(params map[string]interface{}, upstream []Source) (Source, error) {
@@ -166,37 +220,119 @@ func NewFaucet(params map[string]interface{}, upstream []Source) (Source, error)
 		return nil, errors.New("No key provided for faucet")
 	}
 
+	if ret.Bounded() {
+		now := time.Now()
+		if ret.fromTime(now).After(ret.toTime(now)) {
+			return nil, errors.New("Faucet range ends before it starts")
+		}
+	}
+
 	return ret, nil
 }
 
-func (f *Faucet) Stream() (<-chan *events.Event, chan<- bool, error) {
+// Bounded returns true if the faucet ends after replaying a fixed range
+func (f *Faucet) Bounded() bool {
+	return f.To != 0
+}
+
+func faucetTime(t int64, now time.Time) time.Time {
+	if t <= 0 {
+		return now.Add(time.Duration(t) * time.Second)
+	}
+	return time.Unix(t, 0)
+}
+
+func (f *Faucet) fromTime(now time.Time) time.Time {
+	return faucetTime(f.From, now)
+}
+
+func (f *Faucet) toTime(now time.Time) time.Time {
+	return faucetTime(f.To, now)
+}
+
+func (f *Faucet) Stream(ctx context.Context) (*Stream, error) {
 
-	from := time.Now().Add(time.Duration(f.From) * time.Second)
+	now := time.Now()
+	to := now
+	if f.Bounded() {
+		to = f.toTime(now)
+	}
 
-	results, err := store.Get(f.Key, from, time.Now())
+	results, err := store.Get(f.Key, f.fromTime(now), to)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	if f.Bounded() {
+		return f.replay(ctx, results), nil
+	}
+
+	subscribe := store.Subscribe
+	if f.hub != nil {
+		subscribe = f.hub.subscribe
 	}
 
-	evs, err := store.Subscribe(f.Key)
+	ctx, cancel := context.WithCancel(ctx)
+	updates, err := subscribe(ctx, f.Key)
 	if err != nil {
-		return nil, nil, err
+		cancel()
+		return nil, err
 	}
-	ret, stopret := makeDownstream()
+
+	ret := newStream()
 
 	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
 
 		for _, rec := range results.Records {
-			ret <- events.NewEvent(results.Key, rec.Time, rec.Value)
+			if !ret.send(ctx, events.NewEvent(results.Key, rec.Time, rec.Value)) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		for {
+			select {
+			case res, ok := <-updates:
+				if !ok {
+					if ctx.Err() != nil {
+						ret.end(ctx.Err())
+					} else {
+						ret.end(fmt.Errorf("Subscription to %s ended", f.Key))
+					}
+					return
+				}
+				for _, rec := range res.Records {
+					if !ret.send(ctx, events.NewEvent(res.Key, rec.Time, rec.Value)) {
+						ret.end(ctx.Err())
+						return
+					}
+				}
+			case <-ctx.Done():
+				ret.end(ctx.Err())
+				return
+			}
 		}
+	}()
 
-		for res := range evs {
-			for _, rec := range res.Records {
+	return ret, nil
+}
+
+// replay streams stored results and ends
+func (f *Faucet) replay(ctx context.Context, results events.Result) *Stream {
 
-				ret <- events.NewEvent(res.Key, rec.Time, rec.Value)
+	ret := newStream()
+
+	go func() {
+		for _, rec := range results.Records {
+			if !ret.send(ctx, events.NewEvent(results.Key, rec.Time, rec.Value)) {
+				ret.end(ctx.Err())
+				return
 			}
 		}
+		ret.end(nil)
 	}()
-	return ret, stopret, nil
 
+	return ret
 }
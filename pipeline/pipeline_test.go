@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceSource streams a fixed set of events and closes
+type sliceSource []*events.Event
+
+func (s sliceSource) Stream(ctx context.Context) (*Stream, error) {
+
+	ret := newStream()
+	go func() {
+		for _, ev := range s {
+			if !ret.send(ctx, ev) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+		ret.end(nil)
+	}()
+	return ret, nil
+}
+
+// series builds events for key from values, one second apart starting at unix time 1000
+func series(key string, values ...float64) sliceSource {
+	ret := make(sliceSource, 0, len(values))
+	for i, v := range values {
+		ret = append(ret, events.NewEvent(key, time.Unix(int64(1000+i), 0), v))
+	}
+	return ret
+}
+
+func collect(t *testing.T, s Source) []*events.Event {
+
+	stream, err := s.Stream(context.Background())
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	var ret []*events.Event
+	for ev := range stream.Events {
+		ret = append(ret, ev)
+	}
+	assert.NoError(t, stream.Err())
+	return ret
+}
+
+func values(evs []*events.Event) []float64 {
+	ret := make([]float64, 0, len(evs))
+	for _, ev := range evs {
+		ret = append(ret, ev.Value)
+	}
+	return ret
+}
+
+// failingSource streams its events and then fails
+type failingSource struct {
+	evs sliceSource
+	err error
+}
+
+func (f failingSource) Stream(ctx context.Context) (*Stream, error) {
+
+	ret := newStream()
+	go func() {
+		for _, ev := range f.evs {
+			if !ret.send(ctx, ev) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+		ret.end(f.err)
+	}()
+	return ret, nil
+}
+
+// endlessSource streams an event a second until it's canceled, and reports when it quit
+type endlessSource struct {
+	quit chan error
+}
+
+func (e endlessSource) Stream(ctx context.Context) (*Stream, error) {
+
+	ret := newStream()
+	go func() {
+		for i := int64(0); ret.send(ctx, events.NewEvent("foo", time.Unix(1000+i, 0), 1)); i++ {
+		}
+		ret.end(ctx.Err())
+		e.quit <- ctx.Err()
+	}()
+	return ret, nil
+}
+
+func TestFilter(t *testing.T) {
+
+	f, err := NewFilter(map[string]interface{}{"min": 2, "max": 4}, []Source{series("foo", 1, 2, 3, 4, 5, 3)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 3, 4, 3}, values(collect(t, f)))
+}
+
+func TestErrorPropagation(t *testing.T) {
+
+	boom := errors.New("boom")
+	src := failingSource{series("foo", 1, 2, 3), boom}
+
+	f, err := NewFilter(map[string]interface{}{"min": 0, "max": 10}, []Source{src})
+	assert.NoError(t, err)
+	m, err := NewMovingAverage(map[string]interface{}{"window": 2}, []Source{f})
+	assert.NoError(t, err)
+
+	stream, err := m.Stream(context.Background())
+	assert.NoError(t, err)
+	var evs []*events.Event
+	for ev := range stream.Events {
+		evs = append(evs, ev)
+	}
+	assert.Equal(t, []float64{1.5, 2.5}, values(evs))
+	assert.Equal(t, boom, stream.Err())
+
+	// a failing upstream of a multi upstream operator fails it too
+	sum, err := NewSum(nil, []Source{src, endlessSource{make(chan error, 1)}})
+	assert.NoError(t, err)
+	stream, err = sum.Stream(context.Background())
+	assert.NoError(t, err)
+	for range stream.Events {
+	}
+	assert.Equal(t, boom, stream.Err())
+}
+
+func TestPanic(t *testing.T) {
+
+	// a panicking node ends its stream with an error, which fails its downstream too
+	src := series("foo", 1, 2, 3)
+	m := mapSource(func(ctx context.Context) (*Stream, error) {
+		return mapStream(ctx, src, func(ev *events.Event) (*events.Event, bool) {
+			if ev.Value == 2 {
+				panic("boom")
+			}
+			return ev, true
+		})
+	})
+	sum, err := NewSum(nil, []Source{m, src})
+	assert.NoError(t, err)
+
+	stream, err := sum.Stream(context.Background())
+	assert.NoError(t, err)
+	for range stream.Events {
+	}
+	assert.EqualError(t, stream.Err(), "panic: boom")
+}
+
+// mapSource streams by calling itself
+type mapSource func(ctx context.Context) (*Stream, error)
+
+func (m mapSource) Stream(ctx context.Context) (*Stream, error) {
+	return m(ctx)
+}
+
+func TestCancel(t *testing.T) {
+
+	src := endlessSource{make(chan error, 1)}
+	m, err := NewMovingAverage(map[string]interface{}{"window": 2}, []Source{src})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := m.Stream(ctx)
+	assert.NoError(t, err)
+	<-stream.Events
+	cancel()
+
+	for range stream.Events {
+	}
+	assert.Equal(t, context.Canceled, stream.Err())
+
+	// the cancellation reaches the upstream
+	select {
+	case err := <-src.quit:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Error("Upstream was not canceled")
+	}
+}
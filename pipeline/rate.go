@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+)
+
+// mapStream streams the upstream through f, passing on the events it returns with true, and ends with the upstream.
+// f is called from a single goroutine, so it can keep state between events
+func mapStream(ctx context.Context, upstream Source, f func(ev *events.Event) (*events.Event, bool)) (*Stream, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := upstream.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		for ev := range in.Events {
+			out, ok := f(ev)
+			if !ok {
+				continue
+			}
+			if !ret.send(ctx, out) {
+				logging.Debug("Stream canceled by downstream")
+				ret.end(ctx.Err())
+				return
+			}
+		}
+		ret.end(in.Err())
+	}()
+
+	return ret, nil
+}
+
+// Derivative emits the change per unit of time between consecutive events. It can be negative
+type Derivative struct {
+	// Unit is the time unit of the output in seconds. Defaults to 1, i.e. change per second
+	Unit     float64 `mapstructure:"unit"`
+	upstream Source
+}
+
+func NewDerivative(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Derivative can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &Derivative{Unit: 1}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.Unit <= 0 {
+		return nil, fmt.Errorf("Invalid derivative unit %v", ret.Unit)
+	}
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+func (d *Derivative) Stream(ctx context.Context) (*Stream, error) {
+
+	var prev *events.Event
+	return mapStream(ctx, d.upstream, func(ev *events.Event) (*events.Event, bool) {
+
+		last := prev
+		prev = ev
+		if last == nil {
+			return nil, false
+		}
+
+		dt := ev.Time.Sub(last.Time)
+		if dt <= 0 {
+			return nil, false
+		}
+
+		return events.NewEvent(ev.Key, ev.Time, (ev.Value-last.Value)/perUnit(dt, d.Unit)), true
+	})
+}
+
+// Rate emits the per unit of time rate of a monotonic counter, which is never negative.
+// When the counter goes down, it has either wrapped around at Max, or, if Max is not set, been reset to 0
+type Rate struct {
+	// Unit is the time unit of the output in seconds. Defaults to 1, i.e. rate per second
+	Unit float64 `mapstructure:"unit"`
+	// Max is the value at which the counter wraps around, e.g. 4294967296 for 32 bit counters
+	Max      float64 `mapstructure:"max"`
+	upstream Source
+}
+
+func NewRate(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Rate can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &Rate{Unit: 1}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.Unit <= 0 {
+		return nil, fmt.Errorf("Invalid rate unit %v", ret.Unit)
+	}
+	if ret.Max < 0 {
+		return nil, fmt.Errorf("Invalid counter max %v", ret.Max)
+	}
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+// delta returns the increase of the counter between two values
+func (r *Rate) delta(prev, cur float64) float64 {
+
+	if cur >= prev {
+		return cur - prev
+	}
+
+	// the counter wrapped around
+	if r.Max > 0 && prev <= r.Max {
+		return r.Max - prev + cur
+	}
+
+	// the counter was reset, so it counted from 0 up to cur
+	return cur
+}
+
+func (r *Rate) Stream(ctx context.Context) (*Stream, error) {
+
+	var prev *events.Event
+	return mapStream(ctx, r.upstream, func(ev *events.Event) (*events.Event, bool) {
+
+		last := prev
+		prev = ev
+		if last == nil {
+			return nil, false
+		}
+
+		dt := ev.Time.Sub(last.Time)
+		if dt <= 0 {
+			return nil, false
+		}
+
+		return events.NewEvent(ev.Key, ev.Time, r.delta(last.Value, ev.Value)/perUnit(dt, r.Unit)), true
+	})
+}
+
+// perUnit converts a duration to a number of time units of the given length in seconds
+func perUnit(d time.Duration, unit float64) float64 {
+	return d.Seconds() / unit
+}
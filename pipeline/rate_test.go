@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDerivative(t *testing.T) {
+
+	d, err := NewDerivative(nil, []Source{series("foo", 1, 3, 2, 2)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, -1, 0}, values(collect(t, d)))
+
+	d, err = NewDerivative(map[string]interface{}{"unit": 60}, []Source{series("foo", 1, 3)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{120}, values(collect(t, d)))
+
+	_, err = NewDerivative(map[string]interface{}{"unit": -1}, []Source{series("foo")})
+	assert.Error(t, err)
+}
+
+func TestRate(t *testing.T) {
+
+	// the counter is reset after 30
+	r, err := NewRate(nil, []Source{series("foo", 10, 20, 30, 5, 15)})
+	assert.NoError(t, err)
+	evs := collect(t, r)
+	assert.Equal(t, []float64{10, 10, 5, 10}, values(evs))
+	assert.Equal(t, "foo", evs[0].Key)
+
+	// the counter wraps around at 100
+	r, err = NewRate(map[string]interface{}{"max": 100}, []Source{series("foo", 90, 98, 4)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{8, 6}, values(collect(t, r)))
+
+	// events with the same timestamp are skipped, and rate is per the time between them
+	src := sliceSource{
+		events.NewEvent("foo", time.Unix(1000, 0), 0),
+		events.NewEvent("foo", time.Unix(1000, 0), 5),
+		events.NewEvent("foo", time.Unix(1010, 0), 100),
+	}
+	r, _ = NewRate(nil, []Source{src})
+	assert.Equal(t, []float64{9.5}, values(collect(t, r)))
+}
@@ -0,0 +1,280 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+)
+
+// aggregator reduces the values of a window to one value
+type aggregator func(vals []float64) float64
+
+var aggregators = map[string]aggregator{
+	"min": func(vals []float64) float64 {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			ret = math.Min(ret, v)
+		}
+		return ret
+	},
+	"max": func(vals []float64) float64 {
+		ret := vals[0]
+		for _, v := range vals[1:] {
+			ret = math.Max(ret, v)
+		}
+		return ret
+	},
+	"sum": sum,
+	"avg": func(vals []float64) float64 {
+		return sum(vals) / float64(len(vals))
+	},
+	"count": func(vals []float64) float64 {
+		return float64(len(vals))
+	},
+	"last": func(vals []float64) float64 {
+		return vals[len(vals)-1]
+	},
+}
+
+func sum(vals []float64) float64 {
+	ret := 0.0
+	for _, v := range vals {
+		ret += v
+	}
+	return ret
+}
+
+// parseAggregator returns the aggregator named name - one of the aggregators map, or pNN for the NNth percentile
+func parseAggregator(name string) (aggregator, error) {
+
+	if agg, found := aggregators[name]; found {
+		return agg, nil
+	}
+
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return func(vals []float64) float64 {
+				return percentile(vals, p)
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid aggregation '%s'", name)
+}
+
+// percentile returns the p-th percentile of vals, interpolating between the closest ranks
+func percentile(vals []float64, p float64) float64 {
+
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// Resample groups events into wall clock aligned time windows and emits one aggregated event per window,
+// stamped with the window's start. Windows are tumbling if Step equals Window, or sliding if it's shorter.
+//
+// A window is emitted once the watermark - the latest event time seen minus Lateness - passes its end.
+// Events arriving after all of their windows were emitted are dropped. When the upstream ends,
+// all open windows are emitted
+type Resample struct {
+	// Window is the window length in seconds
+	Window float64 `mapstructure:"window"`
+	// Step is the time between window starts in seconds. Defaults to Window
+	Step float64 `mapstructure:"step"`
+	// Aggregation is one of min, max, avg, sum, count, last or pNN for a percentile. Defaults to avg
+	Aggregation string `mapstructure:"agg"`
+	// Lateness is how long in seconds we wait for late events before closing a window
+	Lateness float64 `mapstructure:"lateness"`
+
+	agg      aggregator
+	upstream Source
+}
+
+func NewResample(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Resample can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &Resample{Aggregation: "avg"}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.Window <= 0 {
+		return nil, fmt.Errorf("Invalid resample window %v", ret.Window)
+	}
+	if ret.Step == 0 {
+		ret.Step = ret.Window
+	}
+	if ret.Step < 0 || ret.Step > ret.Window {
+		return nil, fmt.Errorf("Invalid resample step %v", ret.Step)
+	}
+	if ret.Lateness < 0 {
+		return nil, fmt.Errorf("Invalid resample lateness %v", ret.Lateness)
+	}
+
+	var err error
+	if ret.agg, err = parseAggregator(ret.Aggregation); err != nil {
+		return nil, err
+	}
+
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+type resampleWindow struct {
+	start  time.Time
+	key    string
+	values []float64
+}
+
+// windower tracks the open windows of a resample stream
+type windower struct {
+	window, step, lateness time.Duration
+	agg                    aggregator
+	open                   map[int64]*resampleWindow
+	watermark              time.Time
+}
+
+func (r *Resample) newWindower() *windower {
+	return &windower{
+		window:   seconds(r.Window),
+		step:     seconds(r.Step),
+		lateness: seconds(r.Lateness),
+		agg:      r.agg,
+		open:     make(map[int64]*resampleWindow),
+	}
+}
+
+// add puts an event in all the windows it falls in, and returns the windows closed by the advancing watermark
+func (w *windower) add(ev *events.Event) []*events.Event {
+
+	added := false
+	for start := alignTime(ev.Time, w.step); start.Add(w.window).After(ev.Time); start = start.Add(-w.step) {
+
+		// this window was already emitted
+		if !start.Add(w.window).After(w.watermark) {
+			break
+		}
+
+		win, found := w.open[start.UnixNano()]
+		if !found {
+			win = &resampleWindow{start: start, key: ev.Key}
+			w.open[start.UnixNano()] = win
+		}
+		win.values = append(win.values, ev.Value)
+		added = true
+	}
+
+	if !added {
+		logging.Debug("Dropping late event for %s at %s", ev.Key, ev.Time)
+	}
+
+	if wm := ev.Time.Add(-w.lateness); wm.After(w.watermark) {
+		w.watermark = wm
+	}
+
+	return w.close(w.watermark)
+}
+
+// close removes and aggregates all windows ending up to until, in time order
+func (w *windower) close(until time.Time) []*events.Event {
+	return w.closeWhere(func(win *resampleWindow) bool {
+		return !win.start.Add(w.window).After(until)
+	})
+}
+
+// closeAll removes and aggregates all open windows, in time order
+func (w *windower) closeAll() []*events.Event {
+	return w.closeWhere(func(*resampleWindow) bool {
+		return true
+	})
+}
+
+func (w *windower) closeWhere(pred func(*resampleWindow) bool) []*events.Event {
+
+	var closed []*resampleWindow
+	for k, win := range w.open {
+		if pred(win) {
+			closed = append(closed, win)
+			delete(w.open, k)
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		return closed[i].start.Before(closed[j].start)
+	})
+
+	ret := make([]*events.Event, 0, len(closed))
+	for _, win := range closed {
+		ret = append(ret, events.NewEvent(win.key, win.start, w.agg(win.values)))
+	}
+	return ret
+}
+
+func (r *Resample) Stream(ctx context.Context) (*Stream, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := r.upstream.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+	w := r.newWindower()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		emit := func(out []*events.Event) bool {
+			for _, ev := range out {
+				if !ret.send(ctx, ev) {
+					return false
+				}
+			}
+			return true
+		}
+
+		for ev := range in.Events {
+			if !emit(w.add(ev)) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		// flush whatever is still open, unless the stream was canceled
+		if in.Err() == nil && !emit(w.closeAll()) {
+			ret.end(ctx.Err())
+			return
+		}
+		ret.end(in.Err())
+	}()
+
+	return ret, nil
+}
+
+// alignTime returns the start of the step t falls in, aligned to the unix epoch
+func alignTime(t time.Time, step time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(step))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResample(t *testing.T) {
+
+	// 1000..1009, tumbling 5 second windows
+	src := series("foo", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	r, err := NewResample(map[string]interface{}{"window": 5}, []Source{src})
+	assert.NoError(t, err)
+	evs := collect(t, r)
+	assert.Equal(t, []float64{3, 8}, values(evs))
+	assert.Equal(t, time.Unix(1000, 0), evs[0].Time)
+	assert.Equal(t, time.Unix(1005, 0), evs[1].Time)
+	assert.Equal(t, "foo", evs[0].Key)
+
+	for agg, expected := range map[string][]float64{
+		"min":   {1, 6},
+		"max":   {5, 10},
+		"sum":   {15, 40},
+		"count": {5, 5},
+		"last":  {5, 10},
+		"p50":   {3, 8},
+		"p100":  {5, 10},
+	} {
+		r, err := NewResample(map[string]interface{}{"window": 5, "agg": agg}, []Source{src})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, values(collect(t, r)), agg)
+	}
+
+	// sliding 4 second windows every 2 seconds
+	r, _ = NewResample(map[string]interface{}{"window": 4, "step": 2, "agg": "count"}, []Source{src})
+	evs = collect(t, r)
+	assert.Equal(t, time.Unix(998, 0), evs[0].Time)
+	assert.Equal(t, []float64{2, 4, 4, 4, 4, 2}, values(evs))
+
+	for _, params := range []map[string]interface{}{
+		{},
+		{"window": 5, "step": 10},
+		{"window": 5, "agg": "median"},
+		{"window": 5, "agg": "p101"},
+		{"window": 5, "lateness": -1},
+	} {
+		_, err := NewResample(params, []Source{src})
+		assert.Error(t, err, "%v", params)
+	}
+}
+
+func TestResampleLateness(t *testing.T) {
+
+	ev := func(sec int64, val float64) *events.Event {
+		return events.NewEvent("foo", time.Unix(sec, 0), val)
+	}
+
+	// the event at 1003 arrives after the window closed and is dropped
+	src := sliceSource{ev(1000, 1), ev(1006, 2), ev(1003, 100), ev(1011, 3)}
+	r, _ := NewResample(map[string]interface{}{"window": 5, "agg": "sum"}, []Source{src})
+	assert.Equal(t, []float64{1, 2, 3}, values(collect(t, r)))
+
+	// with enough lateness it's counted
+	r, _ = NewResample(map[string]interface{}{"window": 5, "agg": "sum", "lateness": 5}, []Source{src})
+	assert.Equal(t, []float64{101, 2, 3}, values(collect(t, r)))
+}
@@ -0,0 +1,341 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+)
+
+// consumerBuffer is how many updates a consumer of a shared subscription or source may fall behind before it's
+// dropped
+const consumerBuffer = 1000
+
+// ErrSlowConsumer ends the stream of a shared source's consumer that fell too far behind the others
+var ErrSlowConsumer = errors.New("Fell too far behind a shared stream")
+
+// Hub shares running sources between the queries evaluated with it, so that e.g. several subscriptions to the same
+// query run it just once. It shares at two levels:
+//
+// Share runs a source once for everyone streaming it under the same key, which identifies the subtree it was
+// created from. The first one starts it, later ones join it as it runs, and it's stopped once the last one goes
+// away. Late joiners just get the events from when they joined, so only sources whose output doesn't depend on when
+// they're started should be shared this way.
+//
+// ShareSubscription makes live faucets share their store subscriptions. Each faucet still replays its own range of
+// stored events first, so it's safe for faucets with history, whose subtrees can't be shared as a whole.
+type Hub struct {
+	lock    sync.Mutex
+	shared  map[string]*broadcast
+	streams map[string]*fanout
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		shared:  make(map[string]*broadcast),
+		streams: make(map[string]*fanout),
+	}
+}
+
+// ShareSubscription returns a copy of a live faucet subscribing through the hub. Other sources are returned as is
+func (h *Hub) ShareSubscription(src Source) Source {
+	f, ok := src.(*Faucet)
+	if !ok || f.Bounded() {
+		return src
+	}
+	ret := *f
+	ret.hub = h
+	return &ret
+}
+
+// Share returns a source streaming src's events through the hub, shared with all other sources shared under key
+func (h *Hub) Share(key string, src Source) Source {
+	return &sharedSource{hub: h, key: key, src: src}
+}
+
+// Len returns the number of running shared subscriptions and sources
+func (h *Hub) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.shared) + len(h.streams)
+}
+
+// broadcast is a running shared subscription, passing its updates on to all of its consumers
+type broadcast struct {
+	hub    *Hub
+	key    string
+	cancel context.CancelFunc
+
+	// lock guards the consumers. When both are needed, the hub's lock is taken first
+	lock      sync.Mutex
+	consumers map[chan events.Result]bool
+}
+
+// subscribe joins the shared subscription to key, starting it if it isn't running. Like Store.Subscribe, the
+// channel is closed once ctx is canceled, and also if the consumer falls too far behind
+func (h *Hub) subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	b, found := h.shared[key]
+	if !found {
+		// the subscription outlives the consumer starting it, so it gets a context of its own
+		bctx, cancel := context.WithCancel(context.Background())
+		updates, err := store.Subscribe(bctx, key)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		b = &broadcast{
+			hub:       h,
+			key:       key,
+			cancel:    cancel,
+			consumers: make(map[chan events.Result]bool),
+		}
+		h.shared[key] = b
+		go b.run(updates)
+	}
+
+	ch := make(chan events.Result, consumerBuffer)
+	b.lock.Lock()
+	b.consumers[ch] = true
+	b.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.leave(ch)
+	}()
+
+	return ch, nil
+}
+
+// leave removes a consumer, stopping the subscription if it was the last one
+func (b *broadcast) leave(ch chan events.Result) {
+
+	b.hub.lock.Lock()
+	defer b.hub.lock.Unlock()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.consumers[ch] {
+		return
+	}
+	b.drop(ch)
+
+	if len(b.consumers) == 0 && b.hub.shared[b.key] == b {
+		logging.Debug("Last consumer of shared subscription %s left, stopping it", b.key)
+		delete(b.hub.shared, b.key)
+		b.cancel()
+	}
+}
+
+func (b *broadcast) run(updates <-chan events.Result) {
+	defer b.cancel()
+
+	for res := range updates {
+		b.lock.Lock()
+		for ch := range b.consumers {
+			select {
+			case ch <- res:
+			default:
+				logging.Warning("Dropping a slow consumer of shared subscription %s", b.key)
+				b.drop(ch)
+			}
+		}
+		b.lock.Unlock()
+	}
+
+	// consumers joining from now on start a new subscription
+	b.hub.lock.Lock()
+	defer b.hub.lock.Unlock()
+	if b.hub.shared[b.key] == b {
+		delete(b.hub.shared, b.key)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.consumers {
+		b.drop(ch)
+	}
+}
+
+// drop removes a consumer and closes its channel. It's called with the lock held
+func (b *broadcast) drop(ch chan events.Result) {
+	delete(b.consumers, ch)
+	close(ch)
+}
+
+// sharedSource is a source shared through a hub
+type sharedSource struct {
+	hub *Hub
+	key string
+	src Source
+}
+
+// fanout is a running shared source, passing its events on to all of its consumers
+type fanout struct {
+	hub    *Hub
+	key    string
+	cancel context.CancelFunc
+	// ready is closed once the source started, with err set if it failed to
+	ready chan struct{}
+	err   error
+
+	// lock guards the consumers. When both are needed, the hub's lock is taken first
+	lock      sync.Mutex
+	consumers map[*consumer]bool
+}
+
+// consumer receives a fanout's events. err is set before events is closed
+type consumer struct {
+	events chan *events.Event
+	err    error
+}
+
+func (s *sharedSource) Stream(ctx context.Context) (*Stream, error) {
+
+	f, c, err := s.hub.join(s.key, s.src)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := newStream()
+
+	go func() {
+		defer ret.endOnPanic()
+
+		for {
+			select {
+			case ev, ok := <-c.events:
+				if !ok {
+					ret.end(c.err)
+					return
+				}
+				// consumers may annotate their events, so each gets its own copy
+				if !ret.send(ctx, ev.Clone()) {
+					f.leave(c)
+					ret.end(ctx.Err())
+					return
+				}
+			case <-ctx.Done():
+				f.leave(c)
+				ret.end(ctx.Err())
+				return
+			}
+		}
+	}()
+
+	return ret, nil
+}
+
+// join adds a consumer to the source shared under key, starting it if it isn't running. The hub isn't locked while
+// the source starts, as shared sources may have shared upstreams of their own
+func (h *Hub) join(key string, src Source) (*fanout, *consumer, error) {
+
+	c := &consumer{events: make(chan *events.Event, consumerBuffer)}
+
+	h.lock.Lock()
+	f, found := h.streams[key]
+	if found {
+		f.lock.Lock()
+		f.consumers[c] = true
+		f.lock.Unlock()
+		h.lock.Unlock()
+
+		<-f.ready
+		if f.err != nil {
+			return nil, nil, f.err
+		}
+		return f, c, nil
+	}
+
+	// the source outlives the consumer starting it, so it gets a context of its own
+	ctx, cancel := context.WithCancel(context.Background())
+	f = &fanout{
+		hub:       h,
+		key:       key,
+		cancel:    cancel,
+		ready:     make(chan struct{}),
+		consumers: map[*consumer]bool{c: true},
+	}
+	h.streams[key] = f
+	h.lock.Unlock()
+
+	stream, err := src.Stream(ctx)
+	if err != nil {
+		f.err = err
+		f.stop(err)
+		close(f.ready)
+		return nil, nil, err
+	}
+
+	go f.run(stream)
+	close(f.ready)
+	return f, c, nil
+}
+
+func (f *fanout) run(stream *Stream) {
+
+	for ev := range stream.Events {
+		f.lock.Lock()
+		for c := range f.consumers {
+			select {
+			case c.events <- ev:
+			default:
+				logging.Warning("Dropping a slow consumer of shared source %s", f.key)
+				f.drop(c, ErrSlowConsumer)
+			}
+		}
+		f.lock.Unlock()
+	}
+
+	f.stop(stream.Err())
+}
+
+// stop removes the source from the hub, so consumers joining from now on start it anew, and ends all its consumers
+func (f *fanout) stop(err error) {
+
+	f.hub.lock.Lock()
+	defer f.hub.lock.Unlock()
+	if f.hub.streams[f.key] == f {
+		delete(f.hub.streams, f.key)
+	}
+	f.cancel()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for c := range f.consumers {
+		f.drop(c, err)
+	}
+}
+
+// leave removes a consumer, stopping the source if it was the last one
+func (f *fanout) leave(c *consumer) {
+
+	f.hub.lock.Lock()
+	defer f.hub.lock.Unlock()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.consumers[c] {
+		return
+	}
+	f.drop(c, nil)
+
+	if len(f.consumers) == 0 && f.hub.streams[f.key] == f {
+		logging.Debug("Last consumer of shared source %s left, stopping it", f.key)
+		delete(f.hub.streams, f.key)
+		f.cancel()
+	}
+}
+
+// drop removes a consumer and ends its events with err. It's called with the lock held
+func (f *fanout) drop(c *consumer, err error) {
+	delete(f.consumers, c)
+	c.err = err
+	close(c.events)
+}
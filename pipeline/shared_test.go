@@ -0,0 +1,301 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// pubStore publishes the events put in it to its subscribers, and counts the subscriptions
+type pubStore struct {
+	lock          sync.Mutex
+	subs          map[string][]chan events.Result
+	subscriptions int
+}
+
+func newPubStore() *pubStore {
+	return &pubStore{subs: make(map[string][]chan events.Result)}
+}
+
+func (p *pubStore) Put(evs ...*events.Event) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, ev := range evs {
+		for _, ch := range p.subs[ev.Key] {
+			ch <- events.Result{Key: ev.Key, Records: []events.Record{ev.Record}}
+		}
+	}
+	return nil
+}
+
+func (p *pubStore) Get(key string, from, to time.Time) (events.Result, error) {
+	return events.Result{Key: key}, nil
+}
+
+func (p *pubStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch := make(chan events.Result)
+	p.subs[key] = append(p.subs[key], ch)
+	p.subscriptions++
+
+	go func() {
+		<-ctx.Done()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		for i, c := range p.subs[key] {
+			if c == ch {
+				p.subs[key] = append(p.subs[key][:i], p.subs[key][i+1:]...)
+			}
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// active returns the number of open subscriptions to a key
+func (p *pubStore) active(key string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.subs[key])
+}
+
+func next(t *testing.T, s *Stream) float64 {
+	select {
+	case ev, ok := <-s.Events:
+		if !ok {
+			t.Fatalf("Stream ended: %v", s.Err())
+		}
+		return ev.Value
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return 0
+}
+
+func TestHub(t *testing.T) {
+
+	st := newPubStore()
+	InitStore(st)
+	defer InitStore(nil)
+
+	hub := NewHub()
+	faucet, err := NewFaucet(map[string]interface{}{"key": "foo"}, nil)
+	assert.NoError(t, err)
+
+	put := func(v float64) {
+		assert.NoError(t, st.Put(events.NewEvent("foo", time.Unix(int64(v), 0), v)))
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	a, err := hub.ShareSubscription(faucet).Stream(ctxA)
+	assert.NoError(t, err)
+	ctxB, cancelB := context.WithCancel(context.Background())
+	b, err := hub.ShareSubscription(faucet).Stream(ctxB)
+	assert.NoError(t, err)
+
+	// both faucets get the updates of a single subscription
+	put(1)
+	assert.Equal(t, 1.0, next(t, a))
+	assert.Equal(t, 1.0, next(t, b))
+	assert.Equal(t, 1, st.subscriptions)
+	assert.Equal(t, 1, hub.Len())
+
+	// the subscription keeps running while it has consumers
+	cancelA()
+	for range a.Events {
+	}
+	assert.Equal(t, context.Canceled, a.Err())
+
+	put(2)
+	assert.Equal(t, 2.0, next(t, b))
+
+	cancelB()
+	for range b.Events {
+	}
+	assert.Eventually(t, func() bool { return st.active("foo") == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, hub.Len())
+
+	// the next faucet subscribes again
+	ctxC, cancelC := context.WithCancel(context.Background())
+	defer cancelC()
+	c, err := hub.ShareSubscription(faucet).Stream(ctxC)
+	assert.NoError(t, err)
+	put(3)
+	assert.Equal(t, 3.0, next(t, c))
+	assert.Equal(t, 2, st.subscriptions)
+
+	// bounded faucets and other sources aren't shared
+	bounded, _ := NewFaucet(map[string]interface{}{"key": "foo", "from": -10, "to": -5}, nil)
+	assert.Equal(t, bounded, hub.ShareSubscription(bounded))
+	src := series("foo", 1)
+	assert.Equal(t, src, hub.ShareSubscription(src))
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+
+	st := newPubStore()
+	InitStore(st)
+	defer InitStore(nil)
+
+	hub := NewHub()
+	faucet, _ := NewFaucet(map[string]interface{}{"key": "foo"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fast, err := hub.ShareSubscription(faucet).Stream(ctx)
+	assert.NoError(t, err)
+	slow, err := hub.ShareSubscription(faucet).Stream(ctx)
+	assert.NoError(t, err)
+
+	// the slow consumer never reads, so it's dropped rather than holding up the fast one
+	for i := 0; i < consumerBuffer+10; i++ {
+		assert.NoError(t, st.Put(events.NewEvent("foo", time.Unix(int64(i), 0), float64(i))))
+		assert.Equal(t, float64(i), next(t, fast))
+	}
+
+	n := 0
+	for range slow.Events {
+		n++
+	}
+	assert.Error(t, slow.Err())
+	assert.True(t, n < consumerBuffer+10)
+}
+
+// chanSource streams the events sent on its channel, and counts how many times it was started
+type chanSource struct {
+	ch     chan *events.Event
+	starts *int32
+	quit   chan error
+}
+
+func (c chanSource) Stream(ctx context.Context) (*Stream, error) {
+
+	atomic.AddInt32(c.starts, 1)
+	ret := newStream()
+	go func() {
+		for {
+			select {
+			case ev := <-c.ch:
+				if !ret.send(ctx, ev) {
+					ret.end(ctx.Err())
+					c.quit <- ctx.Err()
+					return
+				}
+			case <-ctx.Done():
+				ret.end(ctx.Err())
+				c.quit <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return ret, nil
+}
+
+func TestHubShare(t *testing.T) {
+
+	src := chanSource{make(chan *events.Event), new(int32), make(chan error, 1)}
+	hub := NewHub()
+
+	// sources shared under the same key run once, even when nested in other shared sources
+	shared := func() Source {
+		f, err := NewFilter(map[string]interface{}{"min": 0, "max": 100}, []Source{hub.Share("src", src)})
+		assert.NoError(t, err)
+		return hub.Share("filter", f)
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	a, err := shared().Stream(ctxA)
+	assert.NoError(t, err)
+	ctxB, cancelB := context.WithCancel(context.Background())
+	b, err := shared().Stream(ctxB)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(src.starts))
+	assert.Equal(t, 2, hub.Len())
+
+	src.ch <- events.NewEvent("foo", time.Unix(1000, 0), 1)
+	evA, evB := <-a.Events, <-b.Events
+	assert.Equal(t, 1.0, evA.Value)
+	assert.Equal(t, 1.0, evB.Value)
+	// each consumer gets its own copy, so annotating it doesn't affect the others
+	assert.True(t, evA != evB)
+
+	// the source keeps running while it has consumers, and stops with the last one
+	cancelA()
+	for range a.Events {
+	}
+	src.ch <- events.NewEvent("foo", time.Unix(1001, 0), 2)
+	assert.Equal(t, 2.0, next(t, b))
+
+	cancelB()
+	for range b.Events {
+	}
+	select {
+	case err := <-src.quit:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Shared source was not canceled")
+	}
+	assert.Eventually(t, func() bool { return hub.Len() == 0 }, time.Second, time.Millisecond)
+
+	// the next consumer starts it again
+	ctxC, cancelC := context.WithCancel(context.Background())
+	defer cancelC()
+	_, err = shared().Stream(ctxC)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(src.starts))
+}
+
+func TestHubShareEnd(t *testing.T) {
+
+	hub := NewHub()
+	boom := errors.New("boom")
+
+	// blocked holds the source until both consumers joined
+	blocked := make(chan struct{})
+	src := mapSource(func(ctx context.Context) (*Stream, error) {
+		ret := newStream()
+		go func() {
+			<-blocked
+			ret.send(ctx, events.NewEvent("foo", time.Unix(1000, 0), 1))
+			ret.end(boom)
+		}()
+		return ret, nil
+	})
+
+	a, err := hub.Share("src", src).Stream(context.Background())
+	assert.NoError(t, err)
+	b, err := hub.Share("src", src).Stream(context.Background())
+	assert.NoError(t, err)
+	close(blocked)
+
+	// the source's events and error reach all consumers
+	for _, s := range []*Stream{a, b} {
+		assert.Equal(t, []float64{1}, values(drain(s)))
+		assert.Equal(t, boom, s.Err())
+	}
+	assert.Equal(t, 0, hub.Len())
+
+	// a source that fails to start fails its consumers
+	_, err = hub.Share("fail", mapSource(func(ctx context.Context) (*Stream, error) {
+		return nil, boom
+	})).Stream(context.Background())
+	assert.Equal(t, boom, err)
+	assert.Equal(t, 0, hub.Len())
+}
+
+func drain(s *Stream) []*events.Event {
+	var ret []*events.Event
+	for ev := range s.Events {
+		ret = append(ret, ev)
+	}
+	return ret
+}
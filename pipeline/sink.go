@@ -0,0 +1,376 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+)
+
+const (
+	SinkWebhook = "webhook"
+	SinkEmail   = "email"
+	SinkExec    = "exec"
+
+	// notifyQueueSize is the number of notifications a notify operator buffers while its sink is busy
+	notifyQueueSize = 100
+)
+
+// Notification is a message sent to a sink, about an event or an alert
+type Notification struct {
+	Key         string                 `json:"key"`
+	Title       string                 `json:"title"`
+	Time        int64                  `json:"time"`
+	Value       float64                `json:"value"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// NewNotification creates a notification about an event, carrying its annotations
+func NewNotification(ev *events.Event, title string) Notification {
+	return Notification{
+		Key:         ev.Key,
+		Title:       title,
+		Time:        ev.Time.Unix(),
+		Value:       ev.Value,
+		Annotations: ev.Annotations,
+	}
+}
+
+func (n Notification) String() string {
+	return fmt.Sprintf("%s: %s=%v at %s", n.Title, n.Key, n.Value, time.Unix(n.Time, 0).UTC().Format(time.RFC3339))
+}
+
+// Sink delivers notifications somewhere outside timedis. A single Send may carry several notifications grouped together
+type Sink interface {
+	Send(ns ...Notification) error
+}
+
+// SinkFactory creates a sink from its parameters
+type SinkFactory func(params map[string]interface{}) (Sink, error)
+
+var sinks = map[string]SinkFactory{
+	SinkWebhook: NewWebhookSink,
+	SinkEmail:   NewEmailSink,
+	SinkExec:    NewExecSink,
+}
+
+// configured are the sinks set up on the server, which queries and alerts reference by name. Sinks can run commands
+// and reach internal addresses, so API callers can't describe their own
+var (
+	configured     = map[string]SinkConfig{}
+	configuredLock sync.RWMutex
+)
+
+// SinkConfig describes a sink and how it is throttled
+type SinkConfig struct {
+	// Name references a sink configured with ConfigureSinks. Queries and alerts set just the name and throttling
+	Name   string                 `json:"name,omitempty" mapstructure:"name"`
+	Type   string                 `json:"type,omitempty" mapstructure:"type"`
+	Params map[string]interface{} `json:"params,omitempty" mapstructure:"params"`
+	// Limit is the maximum number of notifications per key sent in Per seconds. 0 means no limit
+	Limit int     `json:"limit,omitempty" mapstructure:"limit"`
+	Per   float64 `json:"per,omitempty" mapstructure:"per"`
+	// Group is how many seconds notifications are collected for before they are sent together. 0 sends them at once
+	Group float64 `json:"group,omitempty" mapstructure:"group"`
+}
+
+// ConfigureSinks sets the sinks queries and alerts may notify, by name, replacing the ones configured before
+func ConfigureSinks(cfgs map[string]SinkConfig) error {
+
+	for name, cfg := range cfgs {
+		if _, err := newSink(cfg); err != nil {
+			return fmt.Errorf("Invalid sink '%s': %s", name, err)
+		}
+	}
+
+	configuredLock.Lock()
+	defer configuredLock.Unlock()
+	configured = make(map[string]SinkConfig, len(cfgs))
+	for name, cfg := range cfgs {
+		configured[name] = cfg
+	}
+	return nil
+}
+
+// NewSink creates the configured sink a query or alert references by name. Its own limits, if set, override the
+// configured ones
+func NewSink(cfg SinkConfig) (Sink, error) {
+
+	if cfg.Type != "" || cfg.Params != nil {
+		return nil, errors.New("Sinks are configured on the server, reference one by name instead of setting its type")
+	}
+
+	configuredLock.RLock()
+	base, found := configured[cfg.Name]
+	configuredLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("Unknown sink '%s'", cfg.Name)
+	}
+
+	if cfg.Limit != 0 || cfg.Per != 0 {
+		base.Limit, base.Per = cfg.Limit, cfg.Per
+	}
+	if cfg.Group != 0 {
+		base.Group = cfg.Group
+	}
+	return newSink(base)
+}
+
+// newSink creates the sink described by the config, wrapping it in a Throttle if it's limited or grouped
+func newSink(cfg SinkConfig) (Sink, error) {
+
+	f, found := sinks[cfg.Type]
+	if !found {
+		return nil, fmt.Errorf("Invalid sink type '%s'", cfg.Type)
+	}
+
+	sink, err := f(cfg.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Limit < 0 || cfg.Per < 0 || cfg.Group < 0 {
+		return nil, errors.New("Sink limits can't be negative")
+	}
+	if cfg.Limit > 0 && cfg.Per == 0 {
+		return nil, errors.New("Sink limit needs a period")
+	}
+	if cfg.Limit == 0 && cfg.Group == 0 {
+		return sink, nil
+	}
+
+	return NewThrottle(sink, cfg.Limit, seconds(cfg.Per), seconds(cfg.Group)), nil
+}
+
+// Throttle wraps a sink, capping the notifications sent per key so a flapping series doesn't spam it, and grouping
+// notifications that arrive close together into a single send
+type Throttle struct {
+	sink  Sink
+	limit int
+	per   time.Duration
+	group time.Duration
+
+	lock sync.Mutex
+	// sent holds the times notifications were sent per key, within the last period
+	sent map[string][]time.Time
+	// swept is when keys that sent nothing within the last period were last removed from sent
+	swept   time.Time
+	pending []Notification
+	timer   *time.Timer
+	dropped uint64
+}
+
+func NewThrottle(sink Sink, limit int, per, group time.Duration) *Throttle {
+	return &Throttle{
+		sink:  sink,
+		limit: limit,
+		per:   per,
+		group: group,
+		sent:  make(map[string][]time.Time),
+	}
+}
+
+// allow records a notification for the key, returning false if the key is over its limit
+func (t *Throttle) allow(key string, now time.Time) bool {
+
+	if t.limit == 0 {
+		return true
+	}
+	t.sweep(now)
+
+	sent := t.prune(key, now)
+	if len(sent) >= t.limit {
+		return false
+	}
+	t.sent[key] = append(sent, now)
+	return true
+}
+
+// prune drops the key's sends older than the period, removing the key once it has none
+func (t *Throttle) prune(key string, now time.Time) []time.Time {
+
+	sent := t.sent[key]
+	for len(sent) > 0 && now.Sub(sent[0]) >= t.per {
+		sent = sent[1:]
+	}
+	if len(sent) == 0 {
+		delete(t.sent, key)
+		return nil
+	}
+	t.sent[key] = sent
+	return sent
+}
+
+// sweep prunes all keys once a period, so keys that stop notifying don't stay around forever
+func (t *Throttle) sweep(now time.Time) {
+
+	if now.Sub(t.swept) < t.per {
+		return
+	}
+	for key := range t.sent {
+		t.prune(key, now)
+	}
+	t.swept = now
+}
+
+// Send passes on the notifications within the limit. When grouping, they are sent once the group window passes
+func (t *Throttle) Send(ns ...Notification) error {
+
+	now := time.Now()
+
+	t.lock.Lock()
+	allowed := make([]Notification, 0, len(ns))
+	for _, n := range ns {
+		if t.allow(n.Key, now) {
+			allowed = append(allowed, n)
+		} else {
+			t.dropped++
+		}
+	}
+
+	if t.group == 0 {
+		t.lock.Unlock()
+		if len(allowed) == 0 {
+			return nil
+		}
+		return t.sink.Send(allowed...)
+	}
+
+	t.pending = append(t.pending, allowed...)
+	if t.timer == nil && len(t.pending) > 0 {
+		t.timer = time.AfterFunc(t.group, func() {
+			if err := t.Flush(); err != nil {
+				logging.Error("Could not send notifications: %s", err)
+			}
+		})
+	}
+	t.lock.Unlock()
+	return nil
+}
+
+// Flush sends the pending group right away
+func (t *Throttle) Flush() error {
+
+	t.lock.Lock()
+	ns := t.pending
+	t.pending = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.lock.Unlock()
+
+	if len(ns) == 0 {
+		return nil
+	}
+	return t.sink.Send(ns...)
+}
+
+// Dropped returns the number of notifications dropped for being over the limit
+func (t *Throttle) Dropped() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropped
+}
+
+// Notify sends a notification to a sink for each event, or just for events where the annotation named If is true,
+// and passes all events on unchanged
+type Notify struct {
+	Sink     SinkConfig `mapstructure:"sink"`
+	If       string     `mapstructure:"if"`
+	Title    string     `mapstructure:"title"`
+	sink     Sink
+	upstream Source
+}
+
+func NewNotify(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Notify can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &Notify{}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if ret.sink, err = NewSink(ret.Sink); err != nil {
+		return nil, err
+	}
+	if ret.Title == "" {
+		ret.Title = "timedis notification"
+		if ret.If != "" {
+			ret.Title = "timedis " + ret.If
+		}
+	}
+
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+// notify queues a notification for the event if it should be sent, without waiting for the sink
+func (n *Notify) notify(ev *events.Event, queue chan<- Notification) {
+
+	if n.If != "" {
+		if flag, _ := ev.Annotations[n.If].(bool); !flag {
+			return
+		}
+	}
+
+	select {
+	case queue <- NewNotification(ev, n.Title):
+	default:
+		logging.Warning("Notification queue is full, dropping notification for %s", ev.Key)
+	}
+}
+
+func (n *Notify) Stream(ctx context.Context) (*Stream, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := n.upstream.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+	// sinks can be slow, so they are called from their own goroutine rather than holding up the stream
+	queue := make(chan Notification, notifyQueueSize)
+
+	go func() {
+		defer func() {
+			close(queue)
+			cancel()
+		}()
+		defer ret.endOnPanic()
+
+		for ev := range in.Events {
+			n.notify(ev, queue)
+			if !ret.send(ctx, ev) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+		ret.end(in.Err())
+	}()
+
+	go func() {
+		for notification := range queue {
+			if err := n.sink.Send(notification); err != nil {
+				logging.Error("Could not send notification: %s", err)
+			}
+		}
+		if t, ok := n.sink.(*Throttle); ok {
+			if err := t.Flush(); err != nil {
+				logging.Error("Could not send notifications: %s", err)
+			}
+		}
+	}()
+
+	return ret, nil
+}
@@ -0,0 +1,232 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockSink records every send
+type mockSink struct {
+	lock  sync.Mutex
+	sends [][]Notification
+}
+
+func (m *mockSink) Send(ns ...Notification) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sends = append(m.sends, ns)
+	return nil
+}
+
+func (m *mockSink) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.sends)
+}
+
+func TestThrottle(t *testing.T) {
+
+	sink := &mockSink{}
+	th := NewThrottle(sink, 2, time.Hour, 0)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, th.Send(Notification{Key: "foo", Value: float64(i)}))
+	}
+	assert.NoError(t, th.Send(Notification{Key: "bar"}))
+	assert.Equal(t, 3, sink.count())
+	assert.Equal(t, uint64(3), th.Dropped())
+
+	// grouped notifications are sent together once the window passes
+	sink = &mockSink{}
+	th = NewThrottle(sink, 0, 0, 20*time.Millisecond)
+	assert.NoError(t, th.Send(Notification{Key: "foo"}))
+	assert.NoError(t, th.Send(Notification{Key: "bar"}))
+	assert.Equal(t, 0, sink.count())
+
+	time.Sleep(100 * time.Millisecond)
+	if assert.Equal(t, 1, sink.count()) {
+		assert.Len(t, sink.sends[0], 2)
+	}
+
+	// keys are forgotten once they sent nothing for a period
+	th = NewThrottle(&mockSink{}, 1, time.Minute, 0)
+	now := time.Now()
+	assert.True(t, th.allow("foo", now))
+	assert.True(t, th.allow("bar", now.Add(30*time.Second)))
+	assert.False(t, th.allow("bar", now.Add(time.Minute)))
+	assert.Len(t, th.sent, 1)
+	assert.True(t, th.allow("baz", now.Add(2*time.Minute)))
+	assert.Equal(t, []string{"baz"}, keys(th.sent))
+}
+
+func keys(m map[string][]time.Time) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func TestConfigureSinks(t *testing.T) {
+	defer ConfigureSinks(nil)
+
+	assert.Error(t, ConfigureSinks(map[string]SinkConfig{"bad": {Type: "pigeon"}}))
+	assert.Error(t, ConfigureSinks(map[string]SinkConfig{"bad": {Type: SinkExec, Params: map[string]interface{}{"command": "true"}, Limit: 1}}))
+	assert.NoError(t, ConfigureSinks(map[string]SinkConfig{
+		"ops": {Type: SinkExec, Params: map[string]interface{}{"command": "true"}},
+	}))
+
+	s, err := NewSink(SinkConfig{Name: "ops"})
+	assert.NoError(t, err)
+	assert.IsType(t, &ExecSink{}, s)
+	s, err = NewSink(SinkConfig{Name: "ops", Limit: 1, Per: 60})
+	assert.NoError(t, err)
+	assert.IsType(t, &Throttle{}, s)
+
+	_, err = NewSink(SinkConfig{Name: "pigeon"})
+	assert.Error(t, err)
+	// sinks can't be described outside the server's config
+	_, err = NewSink(SinkConfig{Type: SinkExec, Params: map[string]interface{}{"command": "true"}})
+	assert.Error(t, err)
+	_, err = NewSink(SinkConfig{Name: "ops", Type: SinkWebhook})
+	assert.Error(t, err)
+}
+
+func TestWebhookSink(t *testing.T) {
+
+	var lock sync.Mutex
+	var bodies []string
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		// the first request fails, to exercise retries
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(map[string]interface{}{"url": srv.URL})
+	assert.NoError(t, err)
+	s.(*WebhookSink).backoff = time.Millisecond
+
+	n := Notification{Key: "foo", Title: "cpu is high", Time: 1000, Value: 3}
+	assert.NoError(t, s.Send(n))
+	assert.Equal(t, 2, calls)
+	if assert.Len(t, bodies, 1) {
+		var body struct {
+			Notifications []Notification `json:"notifications"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &body))
+		assert.Equal(t, []Notification{n}, body.Notifications)
+	}
+
+	s, err = NewWebhookSink(map[string]interface{}{"url": srv.URL, "body": `{"text":"{{range .Notifications}}{{.Title}}{{end}}"}`})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Send(n))
+	assert.Equal(t, `{"text":"cpu is high"}`, bodies[1])
+
+	_, err = NewWebhookSink(map[string]interface{}{"url": srv.URL, "body": "{{"})
+	assert.Error(t, err)
+	_, err = NewWebhookSink(map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestEmailSink(t *testing.T) {
+
+	s, err := NewEmailSink(map[string]interface{}{"to": []string{"ops@example.com"}})
+	assert.NoError(t, err)
+
+	var addr string
+	var msg []byte
+	s.(*EmailSink).send = func(a string, _ smtp.Auth, from string, to []string, m []byte) error {
+		addr, msg = a, m
+		return nil
+	}
+
+	assert.NoError(t, s.Send(Notification{Key: "foo", Title: "cpu is high", Value: 3}, Notification{Key: "bar", Title: "disk is full"}))
+	assert.Equal(t, defaultSMTPAddr, addr)
+	assert.Contains(t, string(msg), "Subject: cpu is high (+2)\r\n")
+	assert.Contains(t, string(msg), "disk is full: bar=0")
+
+	// alert names can't inject headers of their own
+	assert.NoError(t, s.Send(Notification{Key: "foo", Title: "cpu is high\r\nBcc: evil@example.com"}))
+	assert.Contains(t, string(msg), "Subject: cpu is high Bcc: evil@example.com\r\n")
+	headers := strings.SplitN(string(msg), "\r\n\r\n", 2)[0]
+	assert.NotContains(t, headers, "\r\nBcc:")
+
+	_, err = NewEmailSink(map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestExecSink(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "out.json")
+	s, err := NewExecSink(map[string]interface{}{"command": "sh", "args": []string{"-c", "cat > " + path}})
+	assert.NoError(t, err)
+
+	n := Notification{Key: "foo", Title: "cpu is high", Value: 3}
+	assert.NoError(t, s.Send(n))
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var ns []Notification
+	assert.NoError(t, json.Unmarshal(b, &ns))
+	assert.Equal(t, []Notification{n}, ns)
+
+	s, err = NewExecSink(map[string]interface{}{"command": "false"})
+	assert.NoError(t, err)
+	assert.Error(t, s.Send(n))
+}
+
+func TestNotify(t *testing.T) {
+
+	src := series("foo", 1, 2, 3)
+	src[1].Annotate(AnnotationAnomaly, true)
+
+	path := filepath.Join(t.TempDir(), "out.json")
+	assert.NoError(t, ConfigureSinks(map[string]SinkConfig{
+		"out": {Type: SinkExec, Params: map[string]interface{}{"command": "sh", "args": []string{"-c", "cat > " + path}}},
+	}))
+	defer ConfigureSinks(nil)
+
+	n, err := NewNotify(map[string]interface{}{
+		"if":   AnnotationAnomaly,
+		"sink": map[string]interface{}{"name": "out"},
+	}, []Source{src})
+	assert.NoError(t, err)
+
+	// all events are passed on
+	assert.Equal(t, []float64{1, 2, 3}, values(collect(t, n)))
+
+	var ns []Notification
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, &ns) == nil {
+			break
+		}
+	}
+	if assert.Len(t, ns, 1) {
+		assert.Equal(t, float64(2), ns[0].Value)
+		assert.Equal(t, "timedis anomaly", ns[0].Title)
+	}
+
+	_, err = NewNotify(map[string]interface{}{"sink": map[string]interface{}{"name": "pigeon"}}, []Source{src})
+	assert.Error(t, err)
+	_, err = NewNotify(map[string]interface{}{"sink": map[string]interface{}{"type": SinkExec, "params": map[string]interface{}{"command": "true"}}}, []Source{src})
+	assert.Error(t, err)
+}
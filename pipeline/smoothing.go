@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+// EWMA is an exponentially weighted moving average that decays with time rather than with the number of samples,
+// so irregularly spaced events are weighted correctly. A value's weight halves every HalfLife seconds
+type EWMA struct {
+	HalfLife float64 `mapstructure:"halfLife"`
+	upstream Source
+}
+
+func NewEWMA(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("EWMA can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &EWMA{}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.HalfLife <= 0 {
+		return nil, fmt.Errorf("Invalid EWMA half life %v", ret.HalfLife)
+	}
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+func (e *EWMA) Stream(ctx context.Context) (*Stream, error) {
+
+	var average float64
+	var last time.Time
+
+	return mapStream(ctx, e.upstream, func(ev *events.Event) (*events.Event, bool) {
+
+		if last.IsZero() {
+			average = ev.Value
+		} else if dt := ev.Time.Sub(last).Seconds(); dt > 0 {
+			alpha := 1 - math.Exp(-dt*math.Ln2/e.HalfLife)
+			average += alpha * (ev.Value - average)
+		}
+		if ev.Time.After(last) {
+			last = ev.Time
+		}
+
+		return events.NewEvent(ev.Key, ev.Time, average), true
+	})
+}
+
+// HoltWinters is additive triple exponential smoothing, for series with a trend and a seasonal cycle of Season
+// samples. It emits the forecast for Horizon samples ahead, stamped with the time it forecasts, once the first
+// season has been seen
+type HoltWinters struct {
+	// Alpha, Beta and Gamma are the smoothing factors of the level, trend and seasonal components, between 0 and 1
+	Alpha float64 `mapstructure:"alpha"`
+	Beta  float64 `mapstructure:"beta"`
+	Gamma float64 `mapstructure:"gamma"`
+	// Season is the number of samples in a seasonal cycle
+	Season int `mapstructure:"season"`
+	// Horizon is the number of samples ahead to forecast. Defaults to 1
+	Horizon  int `mapstructure:"horizon"`
+	upstream Source
+}
+
+func NewHoltWinters(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("HoltWinters can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &HoltWinters{Horizon: 1}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	for name, v := range map[string]float64{"alpha": ret.Alpha, "beta": ret.Beta, "gamma": ret.Gamma} {
+		if v <= 0 || v > 1 {
+			return nil, fmt.Errorf("Invalid HoltWinters %s %v, must be in (0,1]", name, v)
+		}
+	}
+	if ret.Season < 2 {
+		return nil, fmt.Errorf("Invalid HoltWinters season %d", ret.Season)
+	}
+	if ret.Horizon < 0 {
+		return nil, fmt.Errorf("Invalid HoltWinters horizon %d", ret.Horizon)
+	}
+
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+// holtWintersState is the model of a HoltWinters stream
+type holtWintersState struct {
+	*HoltWinters
+	level, trend float64
+	seasonal     []float64
+	// n is the number of samples seen
+	n        int
+	lastTime time.Time
+	// step is the average time between samples, used to stamp forecasts
+	step time.Duration
+}
+
+// update fits the model to the next value, and returns the forecast Horizon samples ahead once it's initialized
+func (s *holtWintersState) update(ev *events.Event) (float64, bool) {
+
+	if s.n > 0 {
+		if dt := ev.Time.Sub(s.lastTime); dt > 0 {
+			s.step += (dt - s.step) / time.Duration(s.n)
+		}
+	}
+	s.lastTime = ev.Time
+
+	idx := s.n % s.Season
+	s.n++
+
+	// the first season initializes the level and seasonal components
+	if s.n <= s.Season {
+		s.seasonal[idx] = ev.Value
+		if s.n < s.Season {
+			return 0, false
+		}
+
+		for _, v := range s.seasonal {
+			s.level += v
+		}
+		s.level /= float64(s.Season)
+		for i := range s.seasonal {
+			s.seasonal[i] -= s.level
+		}
+	} else {
+		lastLevel := s.level
+		s.level = s.Alpha*(ev.Value-s.seasonal[idx]) + (1-s.Alpha)*(s.level+s.trend)
+		s.trend = s.Beta*(s.level-lastLevel) + (1-s.Beta)*s.trend
+		s.seasonal[idx] = s.Gamma*(ev.Value-s.level) + (1-s.Gamma)*s.seasonal[idx]
+	}
+
+	h := s.Horizon
+	return s.level + float64(h)*s.trend + s.seasonal[(idx+h)%s.Season], true
+}
+
+func (hw *HoltWinters) Stream(ctx context.Context) (*Stream, error) {
+
+	state := &holtWintersState{
+		HoltWinters: hw,
+		seasonal:    make([]float64, hw.Season),
+	}
+
+	return mapStream(ctx, hw.upstream, func(ev *events.Event) (*events.Event, bool) {
+
+		forecast, ok := state.update(ev)
+		if !ok {
+			return nil, false
+		}
+		return events.NewEvent(ev.Key, ev.Time.Add(time.Duration(hw.Horizon)*state.step), forecast), true
+	})
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMovingAverage(t *testing.T) {
+
+	m, err := NewMovingAverage(map[string]interface{}{"window": 3}, []Source{series("foo", 1, 2, 3, 4, 5, 6, 100)})
+	assert.NoError(t, err)
+	evs := collect(t, m)
+	assert.Equal(t, []float64{2, 3, 4, 5, 37}, values(evs))
+	assert.Equal(t, time.Unix(1002, 0), evs[0].Time)
+
+	_, err = NewMovingAverage(map[string]interface{}{"window": 0}, []Source{series("foo")})
+	assert.Error(t, err)
+}
+
+func TestEWMA(t *testing.T) {
+
+	// with a half life of one sample, each new value has half the weight
+	e, err := NewEWMA(map[string]interface{}{"halfLife": 1}, []Source{series("foo", 0, 8, 8, 0)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0, 4, 6, 3}, values(collect(t, e)))
+
+	_, err = NewEWMA(nil, []Source{series("foo")})
+	assert.Error(t, err)
+}
+
+func TestHoltWinters(t *testing.T) {
+
+	params := map[string]interface{}{"alpha": 0.5, "beta": 0.1, "gamma": 0.1, "season": 3}
+
+	// a perfectly seasonal series is forecast exactly
+	hw, err := NewHoltWinters(params, []Source{series("foo", 1, 2, 3, 1, 2, 3, 1, 2, 3)})
+	assert.NoError(t, err)
+	evs := collect(t, hw)
+	assert.Len(t, evs, 7)
+	for i, ev := range evs {
+		assert.InDelta(t, float64((i+3)%3+1), ev.Value, 1e-9)
+	}
+	assert.Equal(t, time.Unix(1003, 0), evs[0].Time)
+
+	// a linear trend is picked up
+	hw, _ = NewHoltWinters(map[string]interface{}{"alpha": 1, "beta": 1, "gamma": 0.1, "season": 2},
+		[]Source{series("foo", 0, 0, 2, 4, 6, 8, 10)})
+	evs = collect(t, hw)
+	assert.InDelta(t, 12, evs[len(evs)-1].Value, 1e-9)
+
+	for _, p := range []map[string]interface{}{
+		{"alpha": 0, "beta": 0.1, "gamma": 0.1, "season": 3},
+		{"alpha": 0.5, "beta": 1.1, "gamma": 0.1, "season": 3},
+		{"alpha": 0.5, "beta": 0.1, "gamma": 0.1, "season": 1},
+		{"alpha": 0.5, "beta": 0.1, "gamma": 0.1, "season": 3, "horizon": -1},
+	} {
+		_, err := NewHoltWinters(p, []Source{series("foo")})
+		assert.Error(t, err, "%v", p)
+	}
+}
@@ -0,0 +1,311 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+const (
+	OrderTop    = "top"
+	OrderBottom = "bottom"
+
+	// AnnotationRank is the annotation topK adds to the events it emits, from 1 for the first place
+	AnnotationRank = "rank"
+)
+
+// TopK ranks the keys of all its upstreams by their aggregated value over the last Window seconds, and emits the
+// first N of them every Step seconds, annotated with their rank. Steps follow the events' time, not the wall clock,
+// so it works the same over live and historical data. A step is ranked once every key of every upstream has passed
+// its end, so keys arriving at different paces are ranked together. Keys that sent nothing for a whole window don't
+// hold steps back. When the upstreams end, the ranking of the last, partial step is emitted too
+type TopK struct {
+	N int `mapstructure:"n"`
+	// Window is how many seconds of values are aggregated per key. Defaults to 60
+	Window float64 `mapstructure:"window"`
+	// Step is the time between rankings in seconds. Defaults to Window
+	Step float64 `mapstructure:"step"`
+	// Aggregation is how a key's values in the window are combined, like in resample. Defaults to last
+	Aggregation string `mapstructure:"agg"`
+	// Order is top for the highest values, or bottom for the lowest
+	Order string `mapstructure:"order"`
+
+	agg      aggregator
+	upstream []Source
+}
+
+func NewTopK(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) == 0 {
+		return nil, fmt.Errorf("TopK needs at least 1 upstream")
+	}
+
+	ret := &TopK{N: 10, Window: 60, Aggregation: "last", Order: OrderTop}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.N <= 0 {
+		return nil, fmt.Errorf("Invalid topK n %d", ret.N)
+	}
+	if ret.Window <= 0 {
+		return nil, fmt.Errorf("Invalid topK window %v", ret.Window)
+	}
+	if ret.Step == 0 {
+		ret.Step = ret.Window
+	}
+	if ret.Step < 0 {
+		return nil, fmt.Errorf("Invalid topK step %v", ret.Step)
+	}
+	if ret.Order != OrderTop && ret.Order != OrderBottom {
+		return nil, fmt.Errorf("Invalid topK order '%s'", ret.Order)
+	}
+
+	var err error
+	if ret.agg, err = parseAggregator(ret.Aggregation); err != nil {
+		return nil, err
+	}
+
+	ret.upstream = upstream
+	return ret, nil
+}
+
+// ranker keeps the recent values of each key and ranks them
+type ranker struct {
+	n            int
+	window, step time.Duration
+	agg          aggregator
+	bottom       bool
+	values       map[string][]*events.Event
+	// next is the time of the next ranking
+	next time.Time
+
+	// marks holds the time of the last event of each key per upstream, and newest the time of the newest event
+	marks  map[mark]time.Time
+	newest time.Time
+	// ended marks the upstreams that ended
+	ended []bool
+}
+
+// mark identifies a key of an upstream
+type mark struct {
+	idx int
+	key string
+}
+
+func (t *TopK) newRanker() *ranker {
+	return &ranker{
+		n:      t.N,
+		window: seconds(t.Window),
+		step:   seconds(t.Step),
+		agg:    t.agg,
+		bottom: t.Order == OrderBottom,
+		values: make(map[string][]*events.Event),
+		marks:  make(map[mark]time.Time),
+		ended:  make([]bool, len(t.upstream)),
+	}
+}
+
+// add adds an event from upstream idx, and returns the rankings of all the steps it completed
+func (r *ranker) add(idx int, ev *events.Event) []*events.Event {
+
+	if r.next.IsZero() {
+		r.next = alignTime(ev.Time, r.step).Add(r.step)
+	}
+
+	r.values[ev.Key] = append(r.values[ev.Key], ev)
+
+	m := mark{idx, ev.Key}
+	if ev.Time.After(r.marks[m]) {
+		r.marks[m] = ev.Time
+	}
+	if ev.Time.After(r.newest) {
+		r.newest = ev.Time
+	}
+	return r.advance()
+}
+
+// end forgets an upstream that ended, and returns the rankings of the steps that were only waiting for it
+func (r *ranker) end(idx int) []*events.Event {
+	r.ended[idx] = true
+	for m := range r.marks {
+		if m.idx == idx {
+			delete(r.marks, m)
+		}
+	}
+	return r.advance()
+}
+
+// watermark returns the time all active keys have reached, or false if an upstream hasn't sent anything yet. Keys
+// that sent nothing for a window are dropped
+func (r *ranker) watermark() (time.Time, bool) {
+
+	var ret time.Time
+	found := false
+	active := make([]bool, len(r.ended))
+	for m, t := range r.marks {
+		if r.newest.Sub(t) > r.window {
+			delete(r.marks, m)
+			continue
+		}
+		if !found || t.Before(ret) {
+			ret, found = t, true
+		}
+		active[m.idx] = true
+	}
+
+	for i, ended := range r.ended {
+		if !ended && !active[i] {
+			return ret, false
+		}
+	}
+	return ret, found
+}
+
+// advance ranks the steps that every active key has passed
+func (r *ranker) advance() []*events.Event {
+
+	var ret []*events.Event
+	for !r.next.IsZero() {
+		wm, ok := r.watermark()
+		if !ok || wm.Before(r.next) {
+			break
+		}
+		ret = append(ret, r.rankNext()...)
+	}
+	return ret
+}
+
+// rankNext ranks the next step and moves on to the one after it
+func (r *ranker) rankNext() []*events.Event {
+
+	ret := r.rank(r.next)
+	r.next = r.next.Add(r.step)
+
+	// after a gap longer than the window there's nothing to rank until the step of the next event
+	if len(r.values) == 0 {
+		r.next = time.Time{}
+	}
+	return ret
+}
+
+// flush returns the rankings of the remaining steps once the upstreams ended, including the last, partial one
+func (r *ranker) flush() []*events.Event {
+
+	var ret []*events.Event
+	for !r.next.IsZero() && !r.next.After(r.newest) {
+		ret = append(ret, r.rankNext()...)
+	}
+	if !r.next.IsZero() {
+		ret = append(ret, r.rank(r.next)...)
+	}
+	return ret
+}
+
+type ranked struct {
+	key   string
+	value float64
+}
+
+// rank drops values that fell out of the window ending at t, and ranks the keys by the rest
+func (r *ranker) rank(t time.Time) []*events.Event {
+
+	from := t.Add(-r.window)
+	ranks := make([]ranked, 0, len(r.values))
+
+	for key, evs := range r.values {
+		i := 0
+		for i < len(evs) && evs[i].Time.Before(from) {
+			i++
+		}
+		if evs = evs[i:]; len(evs) == 0 {
+			delete(r.values, key)
+			continue
+		}
+		r.values[key] = evs
+
+		vals := make([]float64, 0, len(evs))
+		for _, ev := range evs {
+			if ev.Time.Before(t) {
+				vals = append(vals, ev.Value)
+			}
+		}
+		if len(vals) > 0 {
+			ranks = append(ranks, ranked{key, r.agg(vals)})
+		}
+	}
+
+	sort.Slice(ranks, func(i, j int) bool {
+		if ranks[i].value == ranks[j].value {
+			return ranks[i].key < ranks[j].key
+		}
+		if r.bottom {
+			return ranks[i].value < ranks[j].value
+		}
+		return ranks[i].value > ranks[j].value
+	})
+
+	if len(ranks) > r.n {
+		ranks = ranks[:r.n]
+	}
+
+	ret := make([]*events.Event, 0, len(ranks))
+	for i, rk := range ranks {
+		ret = append(ret, events.NewEvent(rk.key, t, rk.value).Annotate(AnnotationRank, i+1))
+	}
+	return ret
+}
+
+func (t *TopK) Stream(ctx context.Context) (*Stream, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	merged, mergeErr, err := mergeUpstreams(ctx, t.upstream)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+	r := t.newRanker()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		emit := func(out []*events.Event) bool {
+			for _, ev := range out {
+				if !ret.send(ctx, ev) {
+					return false
+				}
+			}
+			return true
+		}
+
+		for iev := range merged {
+			var out []*events.Event
+			if iev.ev == nil {
+				out = r.end(iev.idx)
+			} else {
+				out = r.add(iev.idx, iev.ev)
+			}
+			if !emit(out) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+
+		err := mergeErr()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil && !emit(r.flush()) {
+			err = ctx.Err()
+		}
+		ret.end(err)
+	}()
+
+	return ret, nil
+}
@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// interleave builds one time ordered source from several series of the same length, one second apart
+func interleave(series map[string][]float64, keys ...string) sliceSource {
+	var ret sliceSource
+	for i := range series[keys[0]] {
+		for _, k := range keys {
+			ret = append(ret, events.NewEvent(k, time.Unix(int64(1000+i), 0), series[k][i]))
+		}
+	}
+	return ret
+}
+
+func ranking(evs []*events.Event) []string {
+	ret := make([]string, 0, len(evs))
+	for _, ev := range evs {
+		ret = append(ret, ev.Key)
+	}
+	return ret
+}
+
+func unique(keys []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+func TestTopK(t *testing.T) {
+
+	src := interleave(map[string][]float64{
+		"a": {1, 2, 3, 4, 5, 6},
+		"b": {6, 5, 4, 3, 2, 1},
+		"c": {3, 3, 3, 3, 3, 3},
+	}, "a", "b", "c")
+
+	k, err := NewTopK(map[string]interface{}{"n": 2, "window": 2}, []Source{src})
+	assert.NoError(t, err)
+	evs := collect(t, k)
+
+	assert.Equal(t, []string{"b", "c", "a", "b", "a", "c"}, ranking(evs))
+	assert.Equal(t, []float64{5, 3, 4, 3, 6, 3}, values(evs))
+	assert.Equal(t, time.Unix(1002, 0), evs[0].Time)
+	assert.Equal(t, time.Unix(1006, 0), evs[5].Time)
+	assert.Equal(t, 1, evs[0].Annotations[AnnotationRank])
+	assert.Equal(t, 2, evs[1].Annotations[AnnotationRank])
+
+	k, err = NewTopK(map[string]interface{}{"n": 2, "window": 2, "order": "bottom", "agg": "max"}, []Source{src})
+	assert.NoError(t, err)
+	evs = collect(t, k)
+	assert.Equal(t, []string{"a", "c"}, ranking(evs[:2]))
+	assert.Equal(t, []float64{2, 3}, values(evs[:2]))
+
+	// several upstreams are ranked together, step by step
+	xs, ys := make([]float64, 300), make([]float64, 300)
+	for i := range xs {
+		xs[i], ys[i] = 1, 9
+	}
+	k, err = NewTopK(map[string]interface{}{"n": 1, "window": 2}, []Source{series("x", xs...), series("y", ys...)})
+	assert.NoError(t, err)
+	evs = collect(t, k)
+	assert.Len(t, evs, 150)
+	for _, ev := range evs {
+		if !assert.Equal(t, "y", ev.Key, ev.Time) {
+			break
+		}
+	}
+
+	// a step waits for every key of every upstream, whatever order they arrive in
+	r := k.(*TopK).newRanker()
+	for i := range xs {
+		assert.Empty(t, r.add(0, events.NewEvent("x", time.Unix(int64(1000+i), 0), xs[i])))
+	}
+	evs = nil
+	for i := range ys {
+		evs = append(evs, r.add(1, events.NewEvent("y", time.Unix(int64(1000+i), 0), ys[i]))...)
+	}
+	evs = append(evs, r.flush()...)
+	assert.Len(t, evs, 150)
+	assert.Equal(t, []string{"y"}, unique(ranking(evs)))
+
+	// so does every key of a single upstream
+	k, err = NewTopK(map[string]interface{}{"n": 1, "window": 10, "step": 2}, []Source{src})
+	assert.NoError(t, err)
+	r = k.(*TopK).newRanker()
+	evs = r.add(0, events.NewEvent("a", time.Unix(1000, 0), 1))
+	evs = append(evs, r.add(0, events.NewEvent("b", time.Unix(1003, 0), 2))...)
+	assert.Empty(t, evs)
+	evs = r.add(0, events.NewEvent("a", time.Unix(1002, 0), 3))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, "a", evs[0].Key)
+	}
+
+	_, err = NewTopK(map[string]interface{}{"order": "sideways"}, []Source{src})
+	assert.Error(t, err)
+	_, err = NewTopK(map[string]interface{}{"n": 0}, []Source{src})
+	assert.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	stor "github.com/dvirsky/timedis/store"
+)
+
+// WriteBack stores the events of its upstream under Key, materializing a derived stream as a series of its own,
+// and passes them on re-keyed. Events up to the newest one already stored under Key are passed on but not stored
+// again, so a restarted materialization replaying its range doesn't write it twice
+type WriteBack struct {
+	Key      string `mapstructure:"key"`
+	upstream Source
+}
+
+func NewWriteBack(params map[string]interface{}, upstream []Source) (Source, error) {
+
+	if len(upstream) != 1 {
+		return nil, fmt.Errorf("Store can have just 1 upstream, has %d", len(upstream))
+	}
+
+	ret := &WriteBack{}
+	if err := decodeParams(params, ret); err != nil {
+		return nil, err
+	}
+	if ret.Key == "" {
+		return nil, errors.New("No key provided for store")
+	}
+
+	ret.upstream = upstream[0]
+	return ret, nil
+}
+
+// Stream ends with an error if an event can't be stored, so a failing store isn't silently skipped
+func (w *WriteBack) Stream(ctx context.Context) (*Stream, error) {
+
+	if store == nil {
+		return nil, errors.New("No store to write to")
+	}
+
+	written, err := w.written()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the last event stored in %s: %s", w.Key, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := w.upstream.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ret := newStream()
+
+	go func() {
+		defer cancel()
+		defer ret.endOnPanic()
+
+		for ev := range in.Events {
+			out := ev.Clone()
+			out.Key = w.Key
+			if out.Time.After(written) {
+				if err := store.Put(out); err != nil {
+					ret.end(fmt.Errorf("Could not store event in %s: %s", w.Key, err))
+					return
+				}
+			}
+			if !ret.send(ctx, out) {
+				ret.end(ctx.Err())
+				return
+			}
+		}
+		ret.end(in.Err())
+	}()
+
+	return ret, nil
+}
+
+// written returns the time of the newest event stored under the key, or the zero time if there are none. Stores
+// that can't read it on its own are asked for the whole series up to now
+func (w *WriteBack) written() (time.Time, error) {
+
+	if r, ok := store.(stor.LastReader); ok {
+		rec, found, err := r.Last(w.Key)
+		if err != nil || !found {
+			return time.Time{}, err
+		}
+		return rec.Time, nil
+	}
+
+	res, err := store.Get(w.Key, time.Unix(0, 0), time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ret time.Time
+	for _, rec := range res.Records {
+		if rec.Time.After(ret) {
+			ret = rec.Time
+		}
+	}
+	return ret, nil
+}
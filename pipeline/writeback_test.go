@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// memStore keeps events in memory. It doesn't support subscriptions, so only bounded faucets can read from it
+type memStore struct {
+	evs []*events.Event
+}
+
+func (p *memStore) Put(evs ...*events.Event) error {
+	p.evs = append(p.evs, evs...)
+	return nil
+}
+
+func (p *memStore) Get(key string, from, to time.Time) (events.Result, error) {
+	ret := events.Result{Key: key}
+	for _, ev := range p.evs {
+		if ev.Key == key && !ev.Time.Before(from) && !ev.Time.After(to) {
+			ret.Records = append(ret.Records, ev.Record)
+		}
+	}
+	return ret, nil
+}
+
+func (p *memStore) Keys(pattern string) ([]string, error) {
+	found := make(map[string]bool)
+	for _, ev := range p.evs {
+		if ok, _ := path.Match(pattern, ev.Key); ok {
+			found[ev.Key] = true
+		}
+	}
+	ret := make([]string, 0, len(found))
+	for k := range found {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (p *memStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestWriteBack(t *testing.T) {
+
+	st := &memStore{}
+	InitStore(st)
+	defer InitStore(nil)
+
+	src := series("foo", 1, 2)
+	w, err := NewWriteBack(map[string]interface{}{"key": "foo.copy"}, []Source{src})
+	assert.NoError(t, err)
+
+	evs := collect(t, w)
+	assert.Equal(t, []float64{1, 2}, values(evs))
+	assert.Equal(t, "foo.copy", evs[0].Key)
+	assert.Equal(t, "foo", src[0].Key)
+
+	if assert.Len(t, st.evs, 2) {
+		assert.Equal(t, "foo.copy", st.evs[1].Key)
+		assert.Equal(t, src[1].Time, st.evs[1].Time)
+	}
+
+	// a restart replaying the range only stores what's newer than what's already stored
+	w, err = NewWriteBack(map[string]interface{}{"key": "foo.copy"}, []Source{series("foo", 1, 2, 3)})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 2, 3}, values(collect(t, w)))
+	if assert.Len(t, st.evs, 3) {
+		assert.Equal(t, 3.0, st.evs[2].Value)
+	}
+
+	_, err = NewWriteBack(map[string]interface{}{}, []Source{src})
+	assert.Error(t, err)
+}
+
+func TestBoundedFaucet(t *testing.T) {
+
+	st := &memStore{}
+	InitStore(st)
+	defer InitStore(nil)
+	assert.NoError(t, st.Put(series("foo", 1, 2, 3, 4, 5, 6)...))
+	assert.NoError(t, st.Put(series("bar", 10, 20)...))
+
+	f, err := NewFaucet(map[string]interface{}{"key": "foo", "from": 1001, "to": 1004}, nil)
+	assert.NoError(t, err)
+	assert.True(t, f.(*Faucet).Bounded())
+	assert.Equal(t, []float64{2, 3, 4, 5}, values(collect(t, f)))
+
+	// a bounded query ends, so windows still open are flushed
+	r, err := NewResample(map[string]interface{}{"window": 2, "agg": "sum"}, []Source{f})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 7, 5}, values(collect(t, r)))
+
+	g, err := NewFaucet(map[string]interface{}{"key": "bar", "from": 1000, "to": 1010}, nil)
+	assert.NoError(t, err)
+	sum, err := NewSum(map[string]interface{}{"key": "sum"}, []Source{f, g})
+	assert.NoError(t, err)
+	res, err := Collect(context.Background(), sum, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, "sum", res[0].Key)
+		assert.Len(t, res[0].Records, 1)
+		assert.Equal(t, float64(22), res[0].Records[0].Value)
+	}
+
+	_, err = Collect(context.Background(), f, 2)
+	assert.Equal(t, ErrTooManyEvents, err)
+
+	_, err = NewFaucet(map[string]interface{}{"key": "foo", "from": 1004, "to": 1001}, nil)
+	assert.Error(t, err)
+}
@@ -1,7 +1,12 @@
 package ast
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/dvirsky/timedis/pipeline"
 )
@@ -10,9 +15,25 @@ const (
 	TypeFilter        = "filter"
 	TypeMovingAverage = "movingAvg"
 	TypeFaucet        = "faucet"
-)
+	TypeSum           = "sum"
+	TypeDifference    = "diff"
+	TypeProduct       = "product"
+	TypeRatio         = "ratio"
+	TypeDerivative    = "derivative"
+	TypeRate          = "rate"
+	TypeResample      = "resample"
+	TypeEWMA          = "ewma"
+	TypeHoltWinters   = "holtWinters"
+	TypeAnomaly       = "anomaly"
+	TypeNotify        = "notify"
+	TypeStore         = "store"
+	TypeGroupBy       = "groupBy"
+	TypeTopK          = "topK"
+	TypeExpr          = "expr"
 
-var registry map[string]pipeline.SourceFactory
+	// KeyPlaceholder is replaced with each group's key in the faucets of a groupBy template
+	KeyPlaceholder = "$key"
+)
 
 type Node struct {
 	Type     string                 `json:"type"`
@@ -21,8 +42,80 @@ type Node struct {
 }
 
 func (n Node) Eval() (pipeline.Source, error) {
+	return n.eval(nil)
+}
+
+// EvalShared is like Eval, but shares what it can with the other queries evaluated with hub. Identical live subtrees
+// run just once for all of them, and the faucets of the rest share their store subscriptions, so each key is
+// subscribed to just once
+func (n Node) EvalShared(hub *pipeline.Hub) (pipeline.Source, error) {
+	return n.eval(hub)
+}
+
+func (n Node) eval(hub *pipeline.Hub) (pipeline.Source, error) {
+
+	src, err := n.evalNode(hub)
+	if err != nil || hub == nil {
+		return src, err
+	}
+
+	src = hub.ShareSubscription(src)
+	if !n.shareable() {
+		return src, nil
+	}
+	// identical subtrees normalize to the same key, however their params were spelled out
+	key, err := json.Marshal(n.Normalized())
+	if err != nil {
+		return src, nil
+	}
+	return hub.Share(string(key), src), nil
+}
+
+// shareable returns whether the subtree's output doesn't depend on when it's started, so queries can join it as it
+// runs: all its faucets are live with no history to replay, and it has no side effects each query expects of its own
+func (n Node) shareable() bool {
+
+	switch n.Type {
+	case TypeNotify, TypeStore:
+		return false
+	case TypeFaucet:
+		if !zeroParam(n.Params, "from") || !zeroParam(n.Params, "to") {
+			return false
+		}
+	}
 
-	f, found := registry[n.Type]
+	for _, child := range n.Children {
+		if !child.shareable() {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroParam returns whether a numeric param is unset or 0, of whichever numeric type it was given as
+func zeroParam(params map[string]interface{}, name string) bool {
+	v, set := params[name]
+	if !set || v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	}
+	return false
+}
+
+func (n Node) evalNode(hub *pipeline.Hub) (pipeline.Source, error) {
+
+	if n.Type == TypeGroupBy {
+		return n.evalGroupBy(hub)
+	}
+
+	t, found := Lookup(n.Type)
 	if !found {
 		return nil, errors.New("Invalid source type " + n.Type)
 	}
@@ -33,7 +126,7 @@ func (n Node) Eval() (pipeline.Source, error) {
 		children = make([]pipeline.Source, 0, len(n.Children))
 
 		for _, child := range n.Children {
-			if s, err := child.Eval(); err != nil {
+			if s, err := child.eval(hub); err != nil {
 				return nil, err
 			} else {
 				children = append(children, s)
@@ -42,15 +135,111 @@ func (n Node) Eval() (pipeline.Source, error) {
 		}
 	}
 
-	return f(n.Params, children)
+	return t.Factory(n.Params, children)
+}
+
+// evalGroupBy creates a groupBy, whose single child is not evaluated as its upstream but used as a template for the
+// sub-pipeline of each key
+func (n Node) evalGroupBy(hub *pipeline.Hub) (pipeline.Source, error) {
+
+	if len(n.Children) != 1 {
+		return nil, fmt.Errorf("groupBy needs exactly 1 template, has %d", len(n.Children))
+	}
+	tmpl := n.Children[0]
+
+	// make sure the template is valid and actually uses the key, so a bad query fails now rather than per group
+	if !tmpl.usesKey() {
+		return nil, fmt.Errorf("groupBy template has no faucet on %s", KeyPlaceholder)
+	}
+	if _, err := tmpl.withKey("validate").Eval(); err != nil {
+		return nil, err
+	}
+
+	return pipeline.NewGroupBy(n.Params, func(key string) (pipeline.Source, error) {
+		return tmpl.withKey(key).eval(hub)
+	})
+}
+
+func (n Node) faucetKey() (string, bool) {
+	if n.Type != TypeFaucet {
+		return "", false
+	}
+	key, ok := n.Params["key"].(string)
+	return key, ok
+}
+
+func (n Node) usesKey() bool {
+	if key, ok := n.faucetKey(); ok && strings.Contains(key, KeyPlaceholder) {
+		return true
+	}
+	for _, child := range n.Children {
+		if child.usesKey() {
+			return true
+		}
+	}
+	return false
+}
+
+// readsKey returns whether any faucet below the node reads key
+func (n Node) readsKey(key string) bool {
+	for _, child := range n.Children {
+		if k, ok := child.faucetKey(); (ok && k == key) || child.readsKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// withKey returns a copy of the tree with the key placeholder in its faucets replaced by key
+func (n Node) withKey(key string) Node {
+
+	ret := n
+	if k, ok := n.faucetKey(); ok {
+		ret.Params = copyParams(n.Params)
+		ret.Params["key"] = strings.Replace(k, KeyPlaceholder, key, -1)
+	}
+
+	if n.Children != nil {
+		ret.Children = make([]Node, 0, len(n.Children))
+		for _, child := range n.Children {
+			ret.Children = append(ret.Children, child.withKey(key))
+		}
+	}
+	return ret
+}
 
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(params)+2)
+	for k, v := range params {
+		ret[k] = v
+	}
+	return ret
 }
 
-func init() {
-	registry = map[string]pipeline.SourceFactory{
-		TypeFilter:        pipeline.NewFilter,
-		TypeMovingAverage: pipeline.NewMovingAverage,
-		TypeFaucet:        pipeline.NewFaucet,
+// Bounded returns a copy of the tree with every live faucet replaying just the range between from and to, so the
+// query runs over historical data and ends. Faucets that are already bounded keep their range - like the faucets
+// themselves, a "to" of 0 counts as live - and groupBys only look for keys once
+func (n Node) Bounded(from, to time.Time) Node {
+
+	ret := n
+	switch n.Type {
+	case TypeFaucet:
+		if zeroParam(n.Params, "to") {
+			ret.Params = copyParams(n.Params)
+			ret.Params["from"] = from.Unix()
+			ret.Params["to"] = to.Unix()
+		}
+	case TypeGroupBy:
+		// new keys won't show up in the past, so the groupBy can end with its groups
+		ret.Params = copyParams(n.Params)
+		ret.Params["interval"] = 0
 	}
 
+	if n.Children != nil {
+		ret.Children = make([]Node, 0, len(n.Children))
+		for _, child := range n.Children {
+			ret.Children = append(ret.Children, child.Bounded(from, to))
+		}
+	}
+	return ret
 }
@@ -1,10 +1,16 @@
 package ast
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/pipeline"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,3 +39,285 @@ func TestAST(t *testing.T) {
 	fmt.Println(string(b))
 	fmt.Printf("%#v", source)
 }
+
+func TestBounded(t *testing.T) {
+
+	tree := Node{
+		Type:   TypeSum,
+		Params: map[string]interface{}{},
+		Children: []Node{
+			{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo"}},
+			{Type: TypeFaucet, Params: map[string]interface{}{"key": "bar", "from": 10, "to": 20}},
+			{Type: TypeFaucet, Params: map[string]interface{}{"key": "baz", "to": 0.0}},
+		},
+	}
+
+	bounded := tree.Bounded(time.Unix(1000, 0), time.Unix(2000, 0))
+	assert.Equal(t, map[string]interface{}{"key": "foo", "from": int64(1000), "to": int64(2000)}, bounded.Children[0].Params)
+	assert.Equal(t, map[string]interface{}{"key": "bar", "from": 10, "to": 20}, bounded.Children[1].Params)
+	// a "to" of 0 is live, as it is for the faucet itself
+	assert.Equal(t, map[string]interface{}{"key": "baz", "from": int64(1000), "to": int64(2000)}, bounded.Children[2].Params)
+
+	// the original tree is untouched
+	assert.Equal(t, map[string]interface{}{"key": "foo"}, tree.Children[0].Params)
+
+	_, err := bounded.Eval()
+	assert.NoError(t, err)
+}
+
+func TestGroupBy(t *testing.T) {
+
+	tmpl := Node{
+		Type:   TypeMovingAverage,
+		Params: map[string]interface{}{"window": 10},
+		Children: []Node{
+			{Type: TypeFaucet, Params: map[string]interface{}{"key": "$key"}},
+		},
+	}
+	tree := Node{
+		Type:     TypeGroupBy,
+		Params:   map[string]interface{}{"pattern": "sys.net.*.rx"},
+		Children: []Node{tmpl},
+	}
+
+	_, err := tree.Eval()
+	assert.NoError(t, err)
+
+	sub := tmpl.withKey("sys.net.eth0.rx")
+	assert.Equal(t, "sys.net.eth0.rx", sub.Children[0].Params["key"])
+	assert.Equal(t, "$key", tmpl.Children[0].Params["key"])
+
+	assert.Equal(t, 0, tree.Bounded(time.Unix(1000, 0), time.Unix(2000, 0)).Params["interval"])
+
+	// the template has to use the key
+	tree.Children[0].Children[0].Params = map[string]interface{}{"key": "foo"}
+	_, err = tree.Eval()
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+
+	faucet := Node{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo"}}
+
+	valid := Node{
+		Type:     TypeResample,
+		Params:   map[string]interface{}{"window": 60.0, "agg": "p99"},
+		Children: []Node{faucet},
+	}
+	assert.NoError(t, valid.Validate())
+
+	tree := Node{
+		Type:   TypeSum,
+		Params: map[string]interface{}{"fill": "sometimes"},
+		Children: []Node{
+			{Type: TypeMovingAverage, Params: map[string]interface{}{"window": -1.0}, Children: []Node{faucet}},
+			{Type: TypeFilter, Params: map[string]interface{}{"min": "0", "mx": 100.0}, Children: []Node{faucet}},
+			{Type: TypeResample, Params: map[string]interface{}{"window": 10.0, "step": 20.0}, Children: []Node{faucet}},
+			{Type: TypeFaucet, Children: []Node{faucet}},
+			{Type: "bogus"},
+		},
+	}
+
+	err := tree.Validate()
+	if assert.Error(t, err) {
+		errs := err.(ValidationErrors)
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		assert.Equal(t, []string{
+			"query.upstream[0] (movingAvg): param 'window' must be at least 1, got -1",
+			"query.upstream[1] (filter): param 'min' must be a number, got string 0",
+			"query.upstream[1] (filter): param 'max' is required",
+			"query.upstream[1] (filter): unknown param 'mx'",
+			"query.upstream[2] (resample): Invalid resample step 20",
+			"query.upstream[3] (faucet): takes at most 0 upstreams, has 1",
+			"query.upstream[3] (faucet): param 'key' is required",
+			"query.upstream[4] (bogus): unknown node type",
+			"query (sum): param 'fill' must be one of [none previous zero], got 'sometimes'",
+		}, msgs)
+	}
+
+	groupBy := Node{Type: TypeGroupBy, Params: map[string]interface{}{"pattern": "foo.*"}, Children: []Node{faucet}}
+	assert.Error(t, groupBy.Validate())
+
+	// storing into a key the query reads loops
+	loop := Node{Type: TypeStore, Params: map[string]interface{}{"key": "foo"}, Children: []Node{valid}}
+	assert.EqualError(t, loop.Validate(), "Invalid query: query (store): stores into foo, which it reads from")
+	loop.Params["key"] = "foo.p99"
+	assert.NoError(t, loop.Validate())
+}
+
+func TestNormalized(t *testing.T) {
+
+	tree := Node{
+		Type:     TypeAnomaly,
+		Params:   map[string]interface{}{"threshold": 2.0},
+		Children: []Node{{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo"}}},
+	}
+
+	normalized := tree.Normalized()
+	assert.Equal(t, map[string]interface{}{"method": "zscore", "window": 30.0, "threshold": 2.0}, normalized.Params)
+	assert.Equal(t, map[string]interface{}{"key": "foo"}, normalized.Children[0].Params)
+	assert.Equal(t, map[string]interface{}{"threshold": 2.0}, tree.Params)
+	assert.NoError(t, normalized.Validate())
+}
+
+func TestRegister(t *testing.T) {
+
+	double := NodeType{
+		Name: "double",
+		Doc:  "Doubles values",
+		Factory: func(params map[string]interface{}, upstream []pipeline.Source) (pipeline.Source, error) {
+			return pipeline.NewExpr(map[string]interface{}{"expr": "x * 2"}, upstream)
+		},
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params:      []Param{{Name: "key", Type: ParamString}},
+		},
+		Positional: []string{"key"},
+	}
+	assert.NoError(t, Register(double))
+	t.Cleanup(func() { unregister(double.Name) })
+	assert.Error(t, Register(double))
+
+	found, ok := Lookup("double")
+	assert.True(t, ok)
+	assert.Equal(t, "Doubles values", found.Doc)
+
+	tree := Node{Type: "double", Children: []Node{{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo"}}}}
+	assert.NoError(t, tree.Validate())
+	_, err := tree.Eval()
+	assert.NoError(t, err)
+
+	bad := double
+	bad.Name = "triple"
+	bad.Positional = []string{"factor"}
+	assert.Error(t, Register(bad))
+	bad.Positional = nil
+	bad.Factory = nil
+	assert.Error(t, Register(bad))
+	bad.Name = "no spaces"
+	assert.Error(t, Register(bad))
+
+	// built-ins are registered the same way
+	types := Types()
+	names := make([]string, 0, len(types))
+	for _, nt := range types {
+		names = append(names, nt.Name)
+	}
+	assert.True(t, sort.StringsAreSorted(names))
+	assert.Contains(t, names, double.Name)
+	for _, b := range builtins {
+		assert.Contains(t, names, b.Name)
+	}
+}
+
+// pubStore publishes the events put in it to its subscribers, and counts the subscriptions
+type pubStore struct {
+	lock          sync.Mutex
+	subs          []chan events.Result
+	subscriptions int
+}
+
+func (p *pubStore) Put(evs ...*events.Event) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, ev := range evs {
+		for _, ch := range p.subs {
+			ch <- events.Result{Key: ev.Key, Records: []events.Record{ev.Record}}
+		}
+	}
+	return nil
+}
+
+func (p *pubStore) Get(key string, from, to time.Time) (events.Result, error) {
+	return events.Result{Key: key}, nil
+}
+
+func (p *pubStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch := make(chan events.Result)
+	p.subs = append(p.subs, ch)
+	p.subscriptions++
+
+	go func() {
+		<-ctx.Done()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		for i, c := range p.subs {
+			if c == ch {
+				p.subs = append(p.subs[:i], p.subs[i+1:]...)
+			}
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func TestEvalShared(t *testing.T) {
+
+	st := &pubStore{}
+	pipeline.InitStore(st)
+	defer pipeline.InitStore(nil)
+
+	faucet := Node{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo"}}
+	filter := Node{Type: TypeFilter, Params: map[string]interface{}{"min": 0, "max": 100}, Children: []Node{faucet}}
+	movingAvg := Node{Type: TypeMovingAverage, Params: map[string]interface{}{"window": 1}, Children: []Node{filter}}
+	queries := []Node{
+		movingAvg,
+		{Type: TypeSum, Children: []Node{filter, faucet}},
+		movingAvg,
+	}
+
+	hub := pipeline.NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var streams []*pipeline.Stream
+	for _, q := range queries {
+		src, err := q.EvalShared(hub)
+		assert.NoError(t, err)
+		stream, err := src.Stream(ctx)
+		assert.NoError(t, err)
+		streams = append(streams, stream)
+	}
+
+	// all faucets share one subscription, and each distinct subtree runs once: the faucet, filter, movingAvg and sum
+	assert.Equal(t, 1, st.subscriptions)
+	assert.Equal(t, 5, hub.Len())
+
+	assert.NoError(t, st.Put(events.NewEvent("foo", time.Unix(1000, 0), 5)))
+	for i, expected := range []float64{5, 10, 5} {
+		select {
+		case ev := <-streams[i].Events:
+			assert.Equal(t, expected, ev.Value)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event")
+		}
+	}
+
+	cancel()
+	for _, s := range streams {
+		for range s.Events {
+		}
+	}
+	assert.Eventually(t, func() bool { return hub.Len() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestShareable(t *testing.T) {
+
+	live := Node{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo", "from": 0}}
+	history := Node{Type: TypeFaucet, Params: map[string]interface{}{"key": "foo", "from": -60.0}}
+
+	assert.True(t, live.shareable())
+	assert.True(t, Node{Type: TypeSum, Children: []Node{live, live}}.shareable())
+	// subtrees replaying history depend on when they start, and side effects belong to each query
+	assert.False(t, history.shareable())
+	assert.False(t, Node{Type: TypeSum, Children: []Node{live, history}}.shareable())
+	assert.False(t, Node{Type: TypeNotify, Children: []Node{live}}.shareable())
+	assert.False(t, Node{Type: TypeMovingAverage, Children: []Node{{Type: TypeStore, Children: []Node{live}}}}.shareable())
+}
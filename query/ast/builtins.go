@@ -0,0 +1,259 @@
+package ast
+
+import (
+	"github.com/dvirsky/timedis/pipeline"
+)
+
+var (
+	keyParam = Param{Name: "key", Type: ParamString,
+		Doc: "The key of the output events. Defaults to the upstream keys combined"}
+	toleranceParam = Param{Name: "tolerance", Type: ParamNumber, Default: 0.0, Min: bound(0),
+		Doc: "How far apart in seconds events can be and still be aligned"}
+	fillParam = Param{Name: "fill", Type: ParamString, Default: "none", Enum: []string{"none", "previous", "zero"},
+		Doc: "What to use for upstreams with no aligned event"}
+
+	arithmeticSchema = Schema{
+		MinUpstream: 2,
+		MaxUpstream: Unbounded,
+		Params:      []Param{keyParam, toleranceParam, fillParam},
+	}
+)
+
+// builtins are the node types that come with timedis
+var builtins = []NodeType{
+	{
+		Name:    TypeFaucet,
+		Doc:     "Streams a key from the store. Live faucets replay it from a time and then stream new events, bounded ones just replay a range and end",
+		Factory: pipeline.NewFaucet,
+		Schema: Schema{
+			Params: []Param{
+				{Name: "key", Type: ParamString, Required: true, Doc: "The key to stream"},
+				{Name: "from", Type: ParamInt, Doc: "Where to start, in seconds relative to now if 0 or negative, or a unix time"},
+				{Name: "to", Type: ParamInt, Doc: "Where to end, like from. Makes the faucet bounded"},
+			},
+		},
+		Positional: []string{"key", "from", "to"},
+	},
+	{
+		Name:    TypeFilter,
+		Doc:     "Passes on events with values between min and max",
+		Factory: pipeline.NewFilter,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "min", Type: ParamNumber, Default: 0.0, Doc: "The minimal value"},
+				{Name: "max", Type: ParamNumber, Required: true, Doc: "The maximal value"},
+			},
+		},
+		Positional: []string{"min", "max"},
+	},
+	{
+		Name:    TypeMovingAverage,
+		Doc:     "The average of the last window values",
+		Factory: pipeline.NewMovingAverage,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "window", Type: ParamInt, Required: true, Min: bound(1), Doc: "The number of values to average"},
+			},
+		},
+		Positional: []string{"window"},
+	},
+	{
+		Name:    TypeSum,
+		Doc:     "Sums the values of its upstreams, aligned by timestamp",
+		Factory: pipeline.NewSum,
+		Schema:  arithmeticSchema,
+	},
+	{
+		Name:    TypeDifference,
+		Doc:     "Subtracts the values of the rest of its upstreams from the first, aligned by timestamp",
+		Factory: pipeline.NewDifference,
+		Schema:  arithmeticSchema,
+	},
+	{
+		Name:    TypeProduct,
+		Doc:     "Multiplies the values of its upstreams, aligned by timestamp",
+		Factory: pipeline.NewProduct,
+		Schema:  arithmeticSchema,
+	},
+	{
+		Name:    TypeRatio,
+		Doc:     "Divides the values of the first upstream by the rest, aligned by timestamp, skipping divisions by 0",
+		Factory: pipeline.NewRatio,
+		Schema:  arithmeticSchema,
+	},
+	{
+		Name:    TypeDerivative,
+		Doc:     "The change per unit of time between consecutive events",
+		Factory: pipeline.NewDerivative,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "unit", Type: ParamNumber, Default: 1.0, Positive: true, Doc: "The time unit of the output in seconds"},
+			},
+		},
+		Positional: []string{"unit"},
+	},
+	{
+		Name:    TypeRate,
+		Doc:     "The rate of change of a counter, handling counter resets and wraparounds",
+		Factory: pipeline.NewRate,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "unit", Type: ParamNumber, Default: 1.0, Positive: true, Doc: "The time unit of the output in seconds"},
+				{Name: "max", Type: ParamNumber, Default: 0.0, Min: bound(0), Doc: "The value the counter wraps around at. 0 treats drops as resets"},
+			},
+		},
+		Positional: []string{"unit", "max"},
+	},
+	{
+		Name:    TypeResample,
+		Doc:     "Aggregates events into wall clock aligned time windows, emitting one event per window",
+		Factory: pipeline.NewResample,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "window", Type: ParamNumber, Required: true, Positive: true, Doc: "The window length in seconds"},
+				{Name: "step", Type: ParamNumber, Min: bound(0), Doc: "The time between window starts in seconds. Defaults to window"},
+				{Name: "agg", Type: ParamString, Default: "avg", Doc: "One of min, max, avg, sum, count, last or pNN for a percentile"},
+				{Name: "lateness", Type: ParamNumber, Default: 0.0, Min: bound(0), Doc: "How long in seconds to wait for late events"},
+			},
+		},
+		Positional: []string{"window", "agg", "step"},
+	},
+	{
+		Name:    TypeEWMA,
+		Doc:     "An exponentially weighted moving average that decays with time",
+		Factory: pipeline.NewEWMA,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "halfLife", Type: ParamNumber, Required: true, Positive: true, Doc: "The seconds it takes a value's weight to halve"},
+			},
+		},
+		Positional: []string{"halfLife"},
+	},
+	{
+		Name:    TypeHoltWinters,
+		Doc:     "Forecasts series with a trend and a seasonal cycle, using additive triple exponential smoothing",
+		Factory: pipeline.NewHoltWinters,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "alpha", Type: ParamNumber, Required: true, Positive: true, Max: bound(1), Doc: "The smoothing factor of the level"},
+				{Name: "beta", Type: ParamNumber, Required: true, Positive: true, Max: bound(1), Doc: "The smoothing factor of the trend"},
+				{Name: "gamma", Type: ParamNumber, Required: true, Positive: true, Max: bound(1), Doc: "The smoothing factor of the seasonal component"},
+				{Name: "season", Type: ParamInt, Required: true, Min: bound(2), Doc: "The number of samples in a seasonal cycle"},
+				{Name: "horizon", Type: ParamInt, Default: 1.0, Min: bound(0), Doc: "The number of samples ahead to forecast"},
+			},
+		},
+		Positional: []string{"alpha", "beta", "gamma", "season"},
+	},
+	{
+		Name:    TypeAnomaly,
+		Doc:     "Scores each value against a baseline of the values before it, annotating events with the score and whether it exceeds the threshold",
+		Factory: pipeline.NewAnomaly,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "method", Type: ParamString, Default: "zscore", Enum: []string{"zscore", "mad", "seasonal"}, Doc: "How values are scored"},
+				{Name: "window", Type: ParamInt, Default: 30.0, Min: bound(2), Doc: "The number of values, or seasons for the seasonal method, to score against"},
+				{Name: "threshold", Type: ParamNumber, Default: 3.0, Positive: true, Doc: "The score above which a value is anomalous"},
+				{Name: "season", Type: ParamInt, Min: bound(2), Doc: "The number of samples in a cycle, for the seasonal method"},
+			},
+		},
+		Positional: []string{"method", "window", "threshold"},
+	},
+	{
+		Name:    TypeNotify,
+		Doc:     "Sends a notification to a sink for each event, or for events with an annotation, and passes all events on",
+		Factory: pipeline.NewNotify,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "sink", Type: ParamObject, Required: true, Doc: "The sink, as a {name,limit,per,group} object naming a sink configured on the server"},
+				{Name: "if", Type: ParamString, Doc: "An annotation that must be true for events to be notified of"},
+				{Name: "title", Type: ParamString, Doc: "The title of the notifications"},
+			},
+		},
+	},
+	{
+		Name:    TypeStore,
+		Doc:     "Stores the events of its upstream under a key of their own, and passes them on",
+		Factory: pipeline.NewWriteBack,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "key", Type: ParamString, Required: true, Doc: "The key to store events under"},
+			},
+		},
+		Positional: []string{"key"},
+	},
+	{
+		Name:    TypeGroupBy,
+		Doc:     "Runs its upstream as a template for each key matching a pattern, with the key in place of " + KeyPlaceholder + " in its faucets",
+		Factory: groupByFactory,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 1,
+			Params: []Param{
+				{Name: "pattern", Type: ParamString, Required: true, Doc: "The pattern of keys to group"},
+				{Name: "interval", Type: ParamNumber, Default: 10.0, Min: bound(0), Doc: "How often in seconds to look for new keys. 0 only looks once"},
+				{Name: "max", Type: ParamInt, Default: 1000.0, Min: bound(1), Doc: "The maximal number of groups"},
+			},
+		},
+		Positional: []string{"pattern"},
+	},
+	{
+		Name:    TypeTopK,
+		Doc:     "Ranks the keys of its upstreams by their aggregated value over a window, emitting the first n every step",
+		Factory: pipeline.NewTopK,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: Unbounded,
+			Params: []Param{
+				{Name: "n", Type: ParamInt, Default: 10.0, Min: bound(1), Doc: "The number of keys to emit"},
+				{Name: "window", Type: ParamNumber, Default: 60.0, Positive: true, Doc: "The seconds of values to aggregate per key"},
+				{Name: "step", Type: ParamNumber, Min: bound(0), Doc: "The seconds between rankings. Defaults to window"},
+				{Name: "agg", Type: ParamString, Default: "last", Doc: "How a key's values are aggregated, like in resample"},
+				{Name: "order", Type: ParamString, Default: "top", Enum: []string{"top", "bottom"}, Doc: "Whether the highest or lowest values come first"},
+			},
+		},
+		Positional: []string{"n", "agg", "window"},
+	},
+	{
+		Name:    TypeExpr,
+		Doc:     "Evaluates an expression over the values of its upstreams, aligned by timestamp",
+		Factory: pipeline.NewExpr,
+		Schema: Schema{
+			MinUpstream: 1,
+			MaxUpstream: 26,
+			Params: []Param{
+				{Name: "expr", Type: ParamString, Required: true, Doc: "The expression, e.g. (a - b) / a * 100"},
+				{Name: "vars", Type: ParamList, Doc: "The names of the upstreams in the expression. Defaults to x for one upstream, or a, b, c..."},
+				keyParam,
+				toleranceParam,
+				fillParam,
+			},
+		},
+		Positional: []string{"expr"},
+	},
+}
+
+func init() {
+	for _, t := range builtins {
+		MustRegister(t)
+	}
+}
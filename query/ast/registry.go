@@ -0,0 +1,119 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dvirsky/timedis/pipeline"
+)
+
+// NodeType describes a type of query node: how its pipeline source is created, and the params it takes
+type NodeType struct {
+	Name    string                 `json:"name"`
+	Doc     string                 `json:"doc"`
+	Factory pipeline.SourceFactory `json:"-"`
+	Schema  Schema                 `json:"schema"`
+	// Positional lists the params set by positional arguments in the text syntax, in order
+	Positional []string `json:"positional,omitempty"`
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]NodeType{}
+)
+
+// Register adds a node type, making it available to queries. Node types can't be replaced, so registering a name
+// twice is an error
+func Register(t NodeType) error {
+
+	if !isTypeName(t.Name) {
+		return fmt.Errorf("Invalid node type name '%s'", t.Name)
+	}
+	if t.Factory == nil {
+		return fmt.Errorf("Node type %s has no factory", t.Name)
+	}
+	if t.Schema.MinUpstream < 0 || (t.Schema.MaxUpstream != Unbounded && t.Schema.MaxUpstream < t.Schema.MinUpstream) {
+		return fmt.Errorf("Invalid upstream range for node type %s", t.Name)
+	}
+
+	seen := make(map[string]bool, len(t.Schema.Params))
+	for _, p := range t.Schema.Params {
+		if p.Name == "" || seen[p.Name] {
+			return fmt.Errorf("Invalid or duplicate param '%s' in node type %s", p.Name, t.Name)
+		}
+		seen[p.Name] = true
+	}
+	for _, name := range t.Positional {
+		if !seen[name] {
+			return fmt.Errorf("Positional param '%s' of node type %s is not in its schema", name, t.Name)
+		}
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, found := registry[t.Name]; found {
+		return fmt.Errorf("Node type %s is already registered", t.Name)
+	}
+	registry[t.Name] = t
+	return nil
+}
+
+// unregister removes a node type. Registered types are permanent otherwise, it's for tests to clean up after
+// themselves
+func unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
+
+// MustRegister registers a node type, and panics if it can't
+func MustRegister(t NodeType) {
+	if err := Register(t); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup returns a registered node type
+func Lookup(name string) (NodeType, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	t, found := registry[name]
+	return t, found
+}
+
+// Types returns all registered node types, sorted by name
+func Types() []NodeType {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	ret := make([]NodeType, 0, len(registry))
+	for _, t := range registry {
+		ret = append(ret, t)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// isTypeName returns whether a name can be written in the text query syntax
+func isTypeName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// errTemplate is what groupBy's factory returns, as groupBys are built from their template by Node.Eval
+var errTemplate = errors.New("groupBy can only be created from a query node")
+
+func groupByFactory(params map[string]interface{}, upstream []pipeline.Source) (pipeline.Source, error) {
+	return nil, errTemplate
+}
@@ -0,0 +1,136 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ParamType is the type of a node param's value, as it's decoded from json
+type ParamType string
+
+const (
+	ParamNumber ParamType = "number"
+	ParamInt    ParamType = "int"
+	ParamString ParamType = "string"
+	ParamBool   ParamType = "bool"
+	ParamList   ParamType = "list"
+	ParamObject ParamType = "object"
+)
+
+// Unbounded is the MaxUpstream of node types taking any number of upstreams
+const Unbounded = -1
+
+// Param describes a node param
+type Param struct {
+	Name     string      `json:"name"`
+	Type     ParamType   `json:"type"`
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+	// Min and Max bound numeric params inclusively, and Positive requires them to be above 0
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Positive bool     `json:"positive,omitempty"`
+	// Enum lists the valid values of string params
+	Enum []string `json:"enum,omitempty"`
+	Doc  string   `json:"doc,omitempty"`
+}
+
+// Schema describes the params and arity of a node type
+type Schema struct {
+	Params      []Param `json:"params"`
+	MinUpstream int     `json:"minUpstream"`
+	MaxUpstream int     `json:"maxUpstream"`
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+func (s Schema) param(name string) (Param, bool) {
+	for _, p := range s.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// check validates a param's value, returning why it's invalid
+func (p Param) check(val interface{}) error {
+
+	switch p.Type {
+	case ParamNumber, ParamInt:
+		num, ok := toFloat(val)
+		if !ok {
+			return fmt.Errorf("param '%s' must be a number, got %s", p.Name, describe(val))
+		}
+		if p.Type == ParamInt && num != math.Trunc(num) {
+			return fmt.Errorf("param '%s' must be an integer, got %v", p.Name, num)
+		}
+		if p.Positive && num <= 0 {
+			return fmt.Errorf("param '%s' must be above 0, got %v", p.Name, num)
+		}
+		if p.Min != nil && num < *p.Min {
+			return fmt.Errorf("param '%s' must be at least %v, got %v", p.Name, *p.Min, num)
+		}
+		if p.Max != nil && num > *p.Max {
+			return fmt.Errorf("param '%s' must be at most %v, got %v", p.Name, *p.Max, num)
+		}
+
+	case ParamString:
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("param '%s' must be a string, got %s", p.Name, describe(val))
+		}
+		if len(p.Enum) > 0 && !contains(p.Enum, s) {
+			return fmt.Errorf("param '%s' must be one of %v, got '%s'", p.Name, p.Enum, s)
+		}
+
+	case ParamBool:
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("param '%s' must be a bool, got %s", p.Name, describe(val))
+		}
+
+	case ParamList:
+		if val == nil || reflect.TypeOf(val).Kind() != reflect.Slice {
+			return fmt.Errorf("param '%s' must be a list, got %s", p.Name, describe(val))
+		}
+
+	case ParamObject:
+		if val == nil || reflect.TypeOf(val).Kind() != reflect.Map {
+			return fmt.Errorf("param '%s' must be an object, got %s", p.Name, describe(val))
+		}
+	}
+
+	return nil
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
+
+func describe(val interface{}) string {
+	if val == nil {
+		return "null"
+	}
+	return fmt.Sprintf("%T %v", val, val)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package ast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvirsky/timedis/pipeline"
+)
+
+// ValidationError is a problem with a node of a query
+type ValidationError struct {
+	// Path locates the node in the tree, e.g. query.upstream[0]
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Msg  string `json:"error"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Path, e.Type, e.Msg)
+}
+
+// ValidationErrors are all the problems found in a query
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "Invalid query: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the whole tree against the schemas of its node types, and returns all the problems it found as
+// ValidationErrors, or nil if there are none
+func (n Node) Validate() error {
+
+	var errs ValidationErrors
+	n.validate("query", &errs)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (n Node) validate(path string, errs *ValidationErrors) {
+
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Type: n.Type, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	for i, child := range n.Children {
+		child.validate(fmt.Sprintf("%s.upstream[%d]", path, i), errs)
+	}
+	before := len(*errs)
+
+	t, found := Lookup(n.Type)
+	if !found {
+		fail("unknown node type")
+		return
+	}
+	schema := t.Schema
+
+	if len(n.Children) < schema.MinUpstream {
+		fail("needs at least %d upstreams, has %d", schema.MinUpstream, len(n.Children))
+	} else if schema.MaxUpstream != Unbounded && len(n.Children) > schema.MaxUpstream {
+		fail("takes at most %d upstreams, has %d", schema.MaxUpstream, len(n.Children))
+	}
+
+	for _, p := range schema.Params {
+		val, found := n.Params[p.Name]
+		if !found {
+			if p.Required {
+				fail("param '%s' is required", p.Name)
+			}
+			continue
+		}
+		if err := p.check(val); err != nil {
+			fail("%s", err)
+		}
+	}
+
+	unknown := make([]string, 0)
+	for name := range n.Params {
+		if _, found := schema.param(name); !found {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fail("unknown param '%s'", name)
+	}
+
+	if n.Type == TypeGroupBy && len(n.Children) == 1 && !n.Children[0].usesKey() {
+		fail("template has no faucet on %s", KeyPlaceholder)
+	}
+
+	// storing into a key the subtree reads would feed every stored event back into it
+	if key, ok := n.Params["key"].(string); ok && n.Type == TypeStore && n.readsKey(key) {
+		fail("stores into %s, which it reads from", key)
+	}
+
+	// the schema can't express every constraint, e.g. a resample step longer than its window, so once it checks out
+	// we create the node on its own to catch the rest
+	if len(*errs) > before {
+		return
+	}
+	var err error
+	if n.Type == TypeGroupBy {
+		_, err = pipeline.NewGroupBy(n.Params, nil)
+	} else {
+		_, err = t.Factory(n.Params, make([]pipeline.Source, len(n.Children)))
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+// Normalized returns a copy of the tree with the defaults of all unset params filled in
+func (n Node) Normalized() Node {
+
+	ret := n
+	if t, found := Lookup(n.Type); found {
+		ret.Params = copyParams(n.Params)
+		for _, p := range t.Schema.Params {
+			if _, set := ret.Params[p.Name]; !set && p.Default != nil {
+				ret.Params[p.Name] = p.Default
+			}
+		}
+	}
+
+	if n.Children != nil {
+		ret.Children = make([]Node, 0, len(n.Children))
+		for _, child := range n.Children {
+			ret.Children = append(ret.Children, child.Normalized())
+		}
+	}
+	return ret
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvirsky/timedis/query/ast"
+)
+
+// Format writes a query in the text syntax, such that ParseText returns the same tree. Nodes with a single upstream
+// are piped into, and params are positional where possible
+func Format(node ast.Node) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := format(buf, node); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func format(buf *bytes.Buffer, node ast.Node) error {
+
+	var args []string
+	children := node.Children
+
+	// a groupBy's child is a template rather than an upstream, so it reads better as an argument
+	if len(children) == 1 && node.Type != ast.TypeGroupBy {
+		if err := format(buf, children[0]); err != nil {
+			return err
+		}
+		buf.WriteString(" | ")
+		children = nil
+	}
+
+	t, _ := ast.Lookup(node.Type)
+	used := make(map[string]bool, len(node.Params))
+	for _, name := range t.Positional {
+		val, found := node.Params[name]
+		if !found {
+			break
+		}
+		s, err := formatValue(val)
+		if err != nil {
+			return err
+		}
+		args = append(args, s)
+		used[name] = true
+	}
+
+	for _, child := range children {
+		s, err := Format(child)
+		if err != nil {
+			return err
+		}
+		args = append(args, s)
+	}
+
+	names := make([]string, 0, len(node.Params))
+	for name := range node.Params {
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !isIdent(name) {
+			return fmt.Errorf("Param name '%s' of %s can't be written in the text syntax", name, node.Type)
+		}
+		s, err := formatValue(node.Params[name])
+		if err != nil {
+			return err
+		}
+		args = append(args, name+"="+s)
+	}
+
+	if !isIdent(node.Type) {
+		return fmt.Errorf("Node type '%s' can't be written in the text syntax", node.Type)
+	}
+	fmt.Fprintf(buf, "%s(%s)", node.Type, strings.Join(args, ", "))
+	return nil
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !isIdentRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatValue writes a param value, which is the same as in JSON
+func formatValue(val interface{}) (string, error) {
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,127 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// val is the decoded value of strings and numbers
+	val interface{}
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// SyntaxError is a text query parsing error, with the position it was found at
+type SyntaxError struct {
+	Msg string
+	// Offset is the byte offset of the error in the query. Line and Column are 1 based
+	Offset int
+	Line   int
+	Column int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func syntaxError(src string, pos int, format string, args ...interface{}) *SyntaxError {
+	before := src[:pos]
+	return &SyntaxError{
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: pos,
+		Line:   strings.Count(before, "\n") + 1,
+		Column: pos - strings.LastIndex(before, "\n"),
+	}
+}
+
+const punctuation = "()[]{},=:|"
+
+func isIdentRune(r rune, first bool) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (!first && r >= '0' && r <= '9')
+}
+
+func lex(src string) ([]token, error) {
+
+	var ret []token
+	i := 0
+
+	for i < len(src) {
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case strings.ContainsRune(punctuation, c):
+			ret = append(ret, token{kind: tokPunct, text: string(c), pos: i})
+			i++
+
+		case c == '"':
+			start := i
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, syntaxError(src, start, "unterminated string")
+			}
+			i++
+
+			var s string
+			if err := json.Unmarshal([]byte(src[start:i]), &s); err != nil {
+				return nil, syntaxError(src, start, "invalid string %s", src[start:i])
+			}
+			ret = append(ret, token{kind: tokString, text: src[start:i], pos: start, val: s})
+
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			start := i
+			for i++; i < len(src); i++ {
+				d := src[i]
+				if !((d >= '0' && d <= '9') || d == '.' || d == 'e' || d == 'E' ||
+					((d == '+' || d == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+					break
+				}
+			}
+			num, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, syntaxError(src, start, "invalid number '%s'", src[start:i])
+			}
+			ret = append(ret, token{kind: tokNumber, text: src[start:i], pos: start, val: num})
+
+		case isIdentRune(c, true):
+			start := i
+			for i < len(src) && isIdentRune(rune(src[i]), false) {
+				i++
+			}
+			ret = append(ret, token{kind: tokIdent, text: src[start:i], pos: start})
+
+		default:
+			return nil, syntaxError(src, i, "unexpected character '%c'", c)
+		}
+	}
+
+	return append(ret, token{kind: tokEOF, pos: len(src)}), nil
+}
@@ -0,0 +1,269 @@
+package query
+
+import (
+	"github.com/dvirsky/timedis/query/ast"
+)
+
+// parser parses the text query syntax:
+//
+//	query: pipe
+//	pipe:  call ('|' call)*
+//	call:  type '(' (arg (',' arg)*)? ')'
+//	arg:   name '=' value | value | pipe
+//	value: string | number | true | false | null | '[' values ']' | '{' (string ':' value)* '}'
+//
+// A pipe makes each call the upstream of the next, and pipes passed as arguments are upstreams too, so
+//
+//	faucet("a") | sum(faucet("b"))
+//
+// sums a and b. Values are written like in JSON
+type parser struct {
+	src  string
+	toks []token
+	pos  int
+}
+
+// ParseText parses a query written in the text syntax
+func ParseText(query string) (ast.Node, error) {
+
+	toks, err := lex(query)
+	if err != nil {
+		return ast.Node{}, err
+	}
+
+	p := &parser{src: query, toks: toks}
+	node, err := p.parsePipe()
+	if err != nil {
+		return ast.Node{}, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return ast.Node{}, p.errorf(tok, "unexpected %s after the query", tok)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+// peekAt returns the token n places ahead
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isPunct(tok token, punct string) bool {
+	return tok.kind == tokPunct && tok.text == punct
+}
+
+// endOfArgs returns whether the next token closes a list of arguments, elements or fields
+func (p *parser) endOfArgs(closing string) bool {
+	return p.isPunct(p.peek(), closing)
+}
+
+// separator consumes the comma after an argument, unless it's the last one
+func (p *parser) separator(closing string) error {
+	if p.accept(",") || p.endOfArgs(closing) {
+		return nil
+	}
+	tok := p.peek()
+	return p.errorf(tok, "expected ',' or '%s', got %s", closing, tok)
+}
+
+// accept consumes the next token if it's the given punctuation
+func (p *parser) accept(punct string) bool {
+	if p.isPunct(p.peek(), punct) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		tok := p.peek()
+		return p.errorf(tok, "expected '%s', got %s", punct, tok)
+	}
+	return nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return syntaxError(p.src, tok.pos, format, args...)
+}
+
+func (p *parser) parsePipe() (ast.Node, error) {
+
+	node, err := p.parseCall(nil)
+	if err != nil {
+		return node, err
+	}
+
+	for p.accept("|") {
+		if node, err = p.parseCall(&node); err != nil {
+			return node, err
+		}
+	}
+	return node, nil
+}
+
+// parseCall parses a node. piped is the node piped into it, if any, which becomes its first upstream
+func (p *parser) parseCall(piped *ast.Node) (ast.Node, error) {
+
+	name := p.next()
+	if name.kind != tokIdent {
+		return ast.Node{}, p.errorf(name, "expected a node type, got %s", name)
+	}
+	if err := p.expect("("); err != nil {
+		return ast.Node{}, err
+	}
+
+	node := ast.Node{Type: name.text}
+	if piped != nil {
+		node.Children = append(node.Children, *piped)
+	}
+
+	setParam := func(tok token, key string, val interface{}) error {
+		if node.Params == nil {
+			node.Params = make(map[string]interface{})
+		}
+		if _, found := node.Params[key]; found {
+			return p.errorf(tok, "param '%s' of %s is set more than once", key, node.Type)
+		}
+		node.Params[key] = val
+		return nil
+	}
+
+	npositional := 0
+	for !p.endOfArgs(")") {
+
+		tok := p.peek()
+		switch {
+		// named param
+		case tok.kind == tokIdent && p.isPunct(p.peekAt(1), "="):
+			p.pos += 2
+			val, err := p.parseValue()
+			if err != nil {
+				return ast.Node{}, err
+			}
+			if err := setParam(tok, tok.text, val); err != nil {
+				return ast.Node{}, err
+			}
+
+		// upstream
+		case tok.kind == tokIdent && p.isPunct(p.peekAt(1), "("):
+			child, err := p.parsePipe()
+			if err != nil {
+				return ast.Node{}, err
+			}
+			node.Children = append(node.Children, child)
+
+		// positional param
+		default:
+			t, _ := ast.Lookup(node.Type)
+			names := t.Positional
+			if npositional >= len(names) {
+				return ast.Node{}, p.errorf(tok, "too many positional params for %s, it takes %d", node.Type, len(names))
+			}
+			val, err := p.parseValue()
+			if err != nil {
+				return ast.Node{}, err
+			}
+			if err := setParam(tok, names[npositional], val); err != nil {
+				return ast.Node{}, err
+			}
+			npositional++
+		}
+
+		if err := p.separator(")"); err != nil {
+			return ast.Node{}, err
+		}
+	}
+	p.pos++
+
+	return node, nil
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+
+	tok := p.next()
+	switch tok.kind {
+	case tokString, tokNumber:
+		return tok.val, nil
+
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return nil, p.errorf(tok, "unexpected %s, strings must be quoted", tok)
+
+	case tokPunct:
+		switch tok.text {
+		case "[":
+			return p.parseList()
+		case "{":
+			return p.parseObject()
+		}
+	}
+
+	return nil, p.errorf(tok, "expected a value, got %s", tok)
+}
+
+// parseList parses a list, after its opening bracket
+func (p *parser) parseList() (interface{}, error) {
+
+	ret := []interface{}{}
+	for !p.endOfArgs("]") {
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, val)
+
+		if err := p.separator("]"); err != nil {
+			return nil, err
+		}
+	}
+	p.pos++
+	return ret, nil
+}
+
+// parseObject parses an object, after its opening brace
+func (p *parser) parseObject() (interface{}, error) {
+
+	ret := map[string]interface{}{}
+	for !p.endOfArgs("}") {
+		key := p.next()
+		if key.kind != tokString {
+			return nil, p.errorf(key, "expected a quoted object key, got %s", key)
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		ret[key.val.(string)] = val
+
+		if err := p.separator("}"); err != nil {
+			return nil, err
+		}
+	}
+	p.pos++
+	return ret, nil
+}
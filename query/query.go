@@ -2,14 +2,49 @@ package query
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/dvirsky/timedis/query/ast"
 )
 
+// Parse parses a query encoded as json, or written in the text syntax parsed by ParseText, and validates it. All the
+// problems found by validation are returned at once, as ast.ValidationErrors
 func Parse(query string) (ast.Node, error) {
 
 	var node ast.Node
+	var err error
 
-	err := json.Unmarshal([]byte(query), &node)
-	return node, err
+	if strings.HasPrefix(strings.TrimSpace(query), "{") {
+		err = json.Unmarshal([]byte(query), &node)
+	} else {
+		node, err = ParseText(query)
+	}
+	if err != nil {
+		return node, err
+	}
+
+	return node, node.Validate()
+}
+
+// Plan is a validated query with the defaults of all its params filled in
+type Plan struct {
+	// Query is the plan in the text syntax
+	Query string   `json:"query"`
+	Tree  ast.Node `json:"tree"`
+}
+
+// Explain parses and validates a query, and returns its normalized plan
+func Explain(query string) (Plan, error) {
+
+	node, err := Parse(query)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	tree := node.Normalized()
+	text, err := Format(tree)
+	if err != nil {
+		return Plan{}, err
+	}
+	return Plan{Query: text, Tree: tree}, nil
 }
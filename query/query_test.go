@@ -24,3 +24,91 @@ func TestQuery(t *testing.T) {
 	assert.NotNil(t, source)
 	fmt.Printf("%#v", source)
 }
+
+func TestParseText(t *testing.T) {
+
+	node, err := Parse(`faucet("foo.bar", from=-3600) | filter(min=0,max=100) | movingAvg(10)`)
+	assert.NoError(t, err)
+
+	expected, err := Parse(`{"type":"movingAvg","params":{"window":10},"upstream":[
+		{"type":"filter","params":{"min":0,"max":100},"upstream":[
+			{"type":"faucet","params":{"key":"foo.bar","from":-3600}}]}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, node)
+	_, err = node.Eval()
+	assert.NoError(t, err)
+
+	// piped and nested upstreams, positional params, and json values
+	node, err = ParseText(`faucet("a") | ratio(faucet("b") | rate(), key="a/b") |
+		notify(sink={"name": "ops", "tags": ["x", 1.5e3, true, null]})`)
+	assert.NoError(t, err)
+	assert.Equal(t, ast.TypeNotify, node.Type)
+	ratio := node.Children[0]
+	assert.Equal(t, ast.TypeRatio, ratio.Type)
+	assert.Equal(t, "a/b", ratio.Params["key"])
+	assert.Len(t, ratio.Children, 2)
+	assert.Equal(t, "a", ratio.Children[0].Params["key"])
+	assert.Equal(t, ast.TypeRate, ratio.Children[1].Type)
+	assert.Equal(t, []interface{}{"x", 1500.0, true, nil},
+		node.Params["sink"].(map[string]interface{})["tags"])
+}
+
+func TestParseTextErrors(t *testing.T) {
+
+	cases := map[string]string{
+		`faucet("a"`:                       "line 1, column 11",
+		"faucet(\"a\") |\n  filter(min=x)": "line 2, column 14",
+		`faucet("a", "b", 1, 2)`:           "too many positional params",
+		`faucet("a", key="b")`:             "set more than once",
+		`faucet("a) | rate()`:              "unterminated string",
+		`faucet("a") rate()`:               "unexpected 'rate'",
+		`faucet("a" "b")`:                  "expected ',' or ')'",
+		`faucet(from=1-)`:                  "invalid number",
+		`faucet("a") & rate()`:             "unexpected character '&'",
+		`{"type":`:                         "",
+	}
+
+	for q, msg := range cases {
+		_, err := Parse(q)
+		if assert.Error(t, err, q) {
+			assert.Contains(t, err.Error(), msg, q)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+
+	for _, q := range []string{
+		`faucet("foo.bar", -3600) | filter(0, 100) | movingAvg(10)`,
+		`sum(faucet("a"), faucet("b") | rate(), fill="previous", key="a+b")`,
+		`groupBy("sys.net.*.rx", faucet("$key") | rate(1))`,
+		`faucet("x") | expr("x > 3 ? 1 : 0") | notify(if="value > 0", sink={"params":{"url":"http://x/?a=1&b=2"},"type":"webhook"})`,
+	} {
+		node, err := ParseText(q)
+		assert.NoError(t, err, q)
+
+		text, err := Format(node)
+		assert.NoError(t, err)
+		assert.Equal(t, q, text)
+
+		again, err := ParseText(text)
+		assert.NoError(t, err)
+		assert.Equal(t, node, again)
+	}
+
+	_, err := Format(ast.Node{Type: "bad type"})
+	assert.Error(t, err)
+}
+
+func TestExplain(t *testing.T) {
+
+	plan, err := Explain(`faucet("foo") | rate() | movingAvg(10)`)
+	assert.NoError(t, err)
+	assert.Equal(t, `faucet("foo") | rate(1, 0) | movingAvg(10)`, plan.Query)
+	assert.Equal(t, 1.0, plan.Tree.Children[0].Params["unit"])
+
+	_, err = Explain(`faucet("foo") | movingAvg(0) | filter(min=1)`)
+	if assert.Error(t, err) {
+		assert.Len(t, err.(ast.ValidationErrors), 2)
+	}
+}
@@ -0,0 +1,149 @@
+package sampler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/store"
+)
+
+const (
+	// DefaultQueueSize is the default number of flushed batches that can wait for the store
+	DefaultQueueSize = 64
+
+	maxPutAttempts = 5
+	initialBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// batch is a unit of work for the flush worker: final events to write to the store,
+// or partial aggregates to merge in distributed mode
+type batch struct {
+	events   []*events.Event
+	partials []store.Partial
+}
+
+func (b batch) size() int {
+	return len(b.events) + len(b.partials)
+}
+
+// Stats are the sampler's flush counters, all counted in events (or partials in distributed mode)
+// except for Queued which is in batches
+type Stats struct {
+	Flushed  uint64 `json:"flushed"`
+	Retried  uint64 `json:"retried"`
+	Dropped  uint64 `json:"dropped"`
+	Rejected uint64 `json:"rejected"`
+	Queued   int    `json:"queued"`
+}
+
+type stats struct {
+	flushed  uint64
+	retried  uint64
+	dropped  uint64
+	rejected uint64
+}
+
+// Stats returns a snapshot of the sampler's counters
+func (s *Sampler) Stats() Stats {
+	return Stats{
+		Flushed:  atomic.LoadUint64(&s.stats.flushed),
+		Retried:  atomic.LoadUint64(&s.stats.retried),
+		Dropped:  atomic.LoadUint64(&s.stats.dropped),
+		Rejected: atomic.LoadUint64(&s.stats.rejected),
+		Queued:   len(s.queue),
+	}
+}
+
+// enqueue hands a batch to the flush worker without blocking. If the worker is too far behind, it is dropped
+func (s *Sampler) enqueue(b batch) {
+	select {
+	case s.queue <- b:
+	default:
+		atomic.AddUint64(&s.stats.dropped, uint64(b.size()))
+		logging.Error("Flush queue is full, dropping %d samples", b.size())
+	}
+}
+
+// flushWorker writes queued batches one at a time, until the queue is closed by Stop
+func (s *Sampler) flushWorker() {
+	defer close(s.workerDone)
+
+	for b := range s.queue {
+		s.write(b)
+	}
+}
+
+// write flushes a batch to the store or merges its partials, retrying failures. If we give up while stopping,
+// the events are kept for the snapshot. Partials are dropped, since they are meaningless without the other nodes
+func (s *Sampler) write(b batch) {
+
+	if len(b.partials) > 0 {
+		if err := s.retry(len(b.partials), func() error { return s.agg.Merge(b.partials...) }); err != nil {
+			logging.Error("Giving up on merging %d partials: %s", len(b.partials), err)
+			atomic.AddUint64(&s.stats.dropped, uint64(len(b.partials)))
+		}
+	}
+
+	if len(b.events) > 0 {
+		if err := s.retry(len(b.events), func() error { return s.store.Put(b.events...) }); err != nil {
+			logging.Error("Giving up on flushing %d events: %s", len(b.events), err)
+
+			s.lock.Lock()
+			if s.stopped {
+				s.unflushed = append(s.unflushed, b.events...)
+			} else {
+				atomic.AddUint64(&s.stats.dropped, uint64(len(b.events)))
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// finalize lets the leader node turn the merged partials of intervals that ended before the grace period
+// into events, and queues them for writing
+func (s *Sampler) finalize(now time.Time) {
+
+	leader, err := s.agg.Lead(s.node, 3*s.resolution())
+	if err != nil {
+		logging.Error("Could not acquire aggregation leadership: %s", err)
+		return
+	}
+	if !leader {
+		return
+	}
+
+	evs, err := s.agg.Finalize(now.Add(-s.grace))
+	if err != nil {
+		logging.Error("Could not finalize aggregates: %s", err)
+	}
+	if len(evs) > 0 {
+		s.enqueue(batch{events: evs})
+	}
+}
+
+// retry calls f until it succeeds, with exponential backoff between attempts. n is the number of
+// events or partials f writes, for the counters
+func (s *Sampler) retry(n int, f func() error) (err error) {
+
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil {
+			atomic.AddUint64(&s.stats.flushed, uint64(n))
+			return nil
+		}
+
+		if attempt == maxPutAttempts {
+			return err
+		}
+
+		logging.Warning("Error flushing %d samples (attempt %d): %s", n, attempt, err)
+		atomic.AddUint64(&s.stats.retried, uint64(n))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
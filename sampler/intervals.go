@@ -0,0 +1,95 @@
+package sampler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefixInterval is a flush interval for all keys starting with a prefix
+type prefixInterval struct {
+	prefix   string
+	interval time.Duration
+}
+
+// SetInterval sets the flush interval for keys starting with prefix. A trailing "*" is ignored, so "app.*" and
+// "app." are the same. When several prefixes match a key, the longest one wins
+func (s *Sampler) SetInterval(prefix string, interval time.Duration) error {
+
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval for %s: %s", prefix, interval)
+	}
+	prefix = strings.TrimSuffix(prefix, "*")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.intervals {
+		if s.intervals[i].prefix == prefix {
+			s.intervals[i].interval = interval
+			return nil
+		}
+	}
+
+	s.intervals = append(s.intervals, prefixInterval{prefix: prefix, interval: interval})
+	sort.Slice(s.intervals, func(i, j int) bool {
+		return len(s.intervals[i].prefix) > len(s.intervals[j].prefix)
+	})
+	return nil
+}
+
+// intervalFor returns the flush interval of a key. Must be called with the lock held
+func (s *Sampler) intervalFor(key string) time.Duration {
+	for _, pi := range s.intervals {
+		if strings.HasPrefix(key, pi.prefix) {
+			return pi.interval
+		}
+	}
+	return s.tick
+}
+
+// resolution is how often we need to check for samples whose interval has ended - the shortest interval we have
+func (s *Sampler) resolution() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := s.tick
+	for _, pi := range s.intervals {
+		if pi.interval < ret {
+			ret = pi.interval
+		}
+	}
+	return ret
+}
+
+// alignTime returns the start of the interval t falls in. Intervals are aligned to the unix epoch, so series
+// sampled on different hosts share the same timestamps
+func alignTime(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(interval))
+}
+
+// ParseIntervals parses a comma separated list of prefix=duration pairs, e.g. "app.*=10s,sys.*=1s"
+func ParseIntervals(spec string) (map[string]time.Duration, error) {
+
+	ret := make(map[string]time.Duration)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid interval spec '%s'", part)
+		}
+
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		ret[kv[0]] = d
+	}
+	return ret, nil
+}
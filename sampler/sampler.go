@@ -1,8 +1,11 @@
 package sampler
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dvirsky/go-pylog/logging"
@@ -21,17 +24,26 @@ const (
 type sample interface {
 	Update(value, rate float64) error
 	Extract() []*events.Event
+	// Partial returns the sample's state for merging with other nodes. It returns false if there is nothing to merge
+	Partial() (store.Partial, bool)
+	// Window returns the start of the aligned interval the sample aggregates, and the interval's length
+	Window() (time.Time, time.Duration)
 }
 
 type baseSample struct {
-	Key  string
-	lock sync.Mutex
+	Key      string
+	Start    time.Time
+	Interval time.Duration
+	lock     sync.Mutex
+}
+
+func (b *baseSample) Window() (time.Time, time.Duration) {
+	return b.Start, b.Interval
 }
 
 type counter struct {
 	baseSample
-	Duration time.Duration
-	Value    float64
+	Value float64
 }
 
 func (c *counter) Update(value, rate float64) error {
@@ -45,8 +57,13 @@ func (c *counter) Update(value, rate float64) error {
 
 func (c *counter) Extract() []*events.Event {
 
-	return []*events.Event{events.NewEvent(c.Key, time.Now(), c.Value)}
+	return []*events.Event{events.NewEvent(c.Key, c.Start, c.Value)}
+
+}
+
+func (c *counter) Partial() (store.Partial, bool) {
 
+	return store.Partial{Key: c.Key, Time: c.Start, Interval: c.Interval, Sum: c.Value}, true
 }
 
 type timer struct {
@@ -69,77 +86,302 @@ func (c *timer) Extract() []*events.Event {
 	if c.NumSamples == 0 {
 		return nil
 	}
-	return []*events.Event{events.NewEvent(c.Key, time.Now(), c.Value/c.NumSamples)}
+	return []*events.Event{events.NewEvent(c.Key, c.Start, c.Value/c.NumSamples)}
 
 }
 
+func (c *timer) Partial() (store.Partial, bool) {
+
+	if c.NumSamples == 0 {
+		return store.Partial{}, false
+	}
+	return store.Partial{Key: c.Key, Time: c.Start, Interval: c.Interval, Sum: c.Value, Count: c.NumSamples, Average: true}, true
+}
+
+var (
+	// ErrStopped is returned when sampling into a sampler that has been stopped
+	ErrStopped = errors.New("Sampler is stopped")
+	// ErrTooManyKeys is returned when sampling a new key would exceed the sampler's key limit
+	ErrTooManyKeys = errors.New("Too many distinct keys in sampler")
+)
+
 type Sampler struct {
 	lock    sync.Mutex
 	samples map[string]sample
-	tick    time.Duration
-	store   store.Store
+	// ready holds samples whose interval ended while being replaced by a newer sample, awaiting the next flush
+	ready []sample
+	// tick is the default flush interval, for keys not matching any of the prefixes in intervals
+	tick      time.Duration
+	intervals []prefixInterval
+	store     store.Store
+
+	// maxKeys caps the number of distinct keys sampled per interval. 0 means no limit
+	maxKeys int
+
+	// queue feeds the flush worker. When it's full, flushed events are dropped rather than piling up
+	queue   chan batch
+	backoff time.Duration
+	stats   stats
+
+	// started and stopped are set by Run and Stop, guarded by lock
+	started bool
+	stopped bool
+	stopch  chan struct{}
+	// running tracks the ticker loop, workerDone is closed when the flush worker has drained the queue
+	running    sync.WaitGroup
+	workerDone chan struct{}
+	// unflushed collects events the worker gave up on during Stop, guarded by lock
+	unflushed []*events.Event
+
+	// snapshotPath, if set, is where events that could not be flushed on Stop are saved
+	snapshotPath string
+
+	// types caches the type of each key sampled recently, guarded by lock. If registry is set, it is persisted there
+	types    map[string]cachedType
+	registry store.TypeRegistry
+
+	// in distributed mode we merge partial aggregates through agg, and the leader node finalizes them
+	agg   store.Aggregator
+	node  string
+	grace time.Duration
 }
 
 func NewSampler(tick time.Duration, st store.Store) *Sampler {
 
 	return &Sampler{
-		lock:    sync.Mutex{},
-		samples: make(map[string]sample),
-		tick:    tick,
-		store:   st,
+		lock:       sync.Mutex{},
+		samples:    make(map[string]sample),
+		types:      make(map[string]cachedType),
+		tick:       tick,
+		store:      st,
+		queue:      make(chan batch, DefaultQueueSize),
+		backoff:    initialBackoff,
+		stopch:     make(chan struct{}),
+		workerDone: make(chan struct{}),
 	}
 }
 
+// SetMaxKeys caps the number of distinct keys sampled per interval. Samples of new keys beyond it are rejected
+// with ErrTooManyKeys. 0 means no limit
+func (s *Sampler) SetMaxKeys(n int) {
+	s.lock.Lock()
+	s.maxKeys = n
+	s.lock.Unlock()
+}
+
+// SetQueueSize sets how many flushed batches can wait for the store before we start dropping them.
+// It must be called before Run
+func (s *Sampler) SetQueueSize(n int) {
+	s.queue = make(chan batch, n)
+}
+
+// EnableDistributed makes the sampler merge its aggregates with other timedis nodes through agg, instead of writing
+// them to the store directly. Nodes compete for leadership, and the leader finalizes intervals once they have ended
+// for longer than grace, which should cover the flush delay of all nodes. It must be called before Run
+func (s *Sampler) EnableDistributed(agg store.Aggregator, node string, grace time.Duration) {
+	s.agg = agg
+	s.node = node
+	s.grace = grace
+}
+
 func (s *Sampler) Run() {
 
-	go func() {
+	s.lock.Lock()
+	s.started = true
+	s.lock.Unlock()
+
+	go s.flushWorker()
 
-		for range time.Tick(s.tick) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
 
-			go func() {
+		for {
+			// the resolution may change if intervals are added while running, so we don't use a fixed ticker
+			timer := time.NewTimer(s.resolution())
 
-				events := s.flush()
-				if events != nil && len(events) > 0 {
-					logging.Info("Flushing %d events", events)
-					s.store.Put(events...)
+			select {
+			case now := <-timer.C:
+				if b := s.newBatch(s.takeDue(now)); b.size() > 0 {
+					s.enqueue(b)
 				}
-			}()
+				if s.agg != nil {
+					s.finalize(now)
+				}
+			case <-s.stopch:
+				timer.Stop()
+				return
+			}
 		}
 
 	}()
 
 }
 
-func (s *Sampler) flush() []*events.Event {
+// Stop stops the flush loop, performs a final flush of all pending samples and waits for the flush worker to
+// drain its queue. If some events could not be flushed and snapshots are enabled, they are saved to the snapshot
+// file, to be written on the next start. Samples posted after Stop return ErrStopped
+func (s *Sampler) Stop() error {
 
 	s.lock.Lock()
-	samples := s.samples
+	if s.stopped {
+		s.lock.Unlock()
+		return nil
+	}
+	s.stopped = true
+	started := s.started
+	s.lock.Unlock()
+
+	close(s.stopch)
+	s.running.Wait()
+
+	b := s.newBatch(s.takeAll())
+	if started {
+		if b.size() > 0 {
+			logging.Info("Final flush of %d samples", b.size())
+			s.queue <- b
+		}
+		close(s.queue)
+		<-s.workerDone
+	} else if b.size() > 0 {
+		s.write(b)
+	}
+
+	s.lock.Lock()
+	unflushed := s.unflushed
+	s.unflushed = nil
+	s.lock.Unlock()
+
+	if len(unflushed) == 0 {
+		return nil
+	}
+	if s.snapshotPath != "" {
+		logging.Error("Saving %d unflushed events to %s", len(unflushed), s.snapshotPath)
+		return saveSnapshot(s.snapshotPath, unflushed)
+	}
+	return fmt.Errorf("%d events could not be flushed", len(unflushed))
+}
+
+// Close is an alias for Stop, for use as an io.Closer
+func (s *Sampler) Close() error {
+	return s.Stop()
+}
+
+// EnableSnapshots makes Stop save events it could not flush to path. If a snapshot from a previous run exists
+// there, it is written to the store and removed
+func (s *Sampler) EnableSnapshots(path string) error {
+
+	s.snapshotPath = path
+
+	events, err := loadSnapshot(path)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	logging.Info("Restoring %d events from snapshot %s", len(events), path)
+	if err := s.store.Put(events...); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// takeAll removes and returns all pending samples, including those whose interval has not ended yet
+func (s *Sampler) takeAll() []sample {
+
+	s.lock.Lock()
+	samples := s.ready
+	for _, sm := range s.samples {
+		samples = append(samples, sm)
+	}
 	s.samples = make(map[string]sample)
+	s.ready = nil
+	s.lock.Unlock()
+
+	return samples
+
+}
+
+// takeDue removes and returns the samples whose interval has ended by now
+func (s *Sampler) takeDue(now time.Time) []sample {
+
+	s.lock.Lock()
+	samples := s.ready
+	s.ready = nil
+	for key, sm := range s.samples {
+		if start, interval := sm.Window(); !start.Add(interval).After(now) {
+			samples = append(samples, sm)
+			delete(s.samples, key)
+		}
+	}
+	s.expireTypes(now)
 	s.lock.Unlock()
 
+	return samples
+}
+
+// newBatch prepares samples for the flush worker - as final events, or as partials in distributed mode
+func (s *Sampler) newBatch(samples []sample) batch {
+	if s.agg == nil {
+		return batch{events: extract(samples)}
+	}
+
+	ret := batch{partials: make([]store.Partial, 0, len(samples))}
+	for _, sm := range samples {
+		if p, ok := sm.Partial(); ok {
+			ret.partials = append(ret.partials, p)
+		}
+	}
+	return ret
+}
+
+func extract(samples []sample) []*events.Event {
 	ret := make([]*events.Event, 0, len(samples))
 	for _, sm := range samples {
 		ret = append(ret, sm.Extract()...)
 	}
 
 	return ret
+}
 
+// full returns whether sampling key would go over the key limit. It's called with the lock held
+func (s *Sampler) full(key string) bool {
+	if s.maxKeys == 0 {
+		return false
+	}
+	_, found := s.samples[key]
+	return !found && len(s.samples) >= s.maxKeys
 }
 
-func (s *Sampler) get(key string, t SampleType) (sample, error) {
+func (s *Sampler) get(key string, t SampleType, now time.Time) (sample, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if sm, found := s.samples[key]; found {
-		return sm, nil
+	if s.stopped {
+		return nil, ErrStopped
+	}
+
+	interval := s.intervalFor(key)
+	start := alignTime(now, interval)
+
+	sm, found := s.samples[key]
+	if found {
+		if smStart, _ := sm.Window(); smStart.Equal(start) {
+			return sm, nil
+		}
+		// the sample's interval is over but it wasn't flushed yet
+		s.ready = append(s.ready, sm)
+	} else if s.full(key) {
+		atomic.AddUint64(&s.stats.rejected, 1)
+		return nil, ErrTooManyKeys
 	}
 
 	var ret sample
 	switch t {
 	case SampleCounter:
-		ret = newCounter(key)
+		ret = newCounter(key, start, interval)
 	case SampleTimer:
-		ret = newTimer(key)
+		ret = newTimer(key, start, interval)
 	default:
 		return nil, fmt.Errorf("Unsupported sample type: %v", t)
 	}
@@ -149,7 +391,12 @@ func (s *Sampler) get(key string, t SampleType) (sample, error) {
 
 func (s *Sampler) Sample(key string, value, rate float64, t SampleType) error {
 
-	smp, err := s.get(key, t)
+	now := time.Now()
+	if err := s.checkType(key, t, now); err != nil {
+		return err
+	}
+
+	smp, err := s.get(key, t, now)
 	if err != nil {
 		return err
 	}
@@ -158,25 +405,28 @@ func (s *Sampler) Sample(key string, value, rate float64, t SampleType) error {
 
 }
 
-func newCounter(key string) *counter {
+func newCounter(key string, start time.Time, interval time.Duration) *counter {
 
 	c := &counter{
 		baseSample: baseSample{
-			Key:  key,
-			lock: sync.Mutex{},
+			Key:      key,
+			Start:    start,
+			Interval: interval,
+			lock:     sync.Mutex{},
 		},
-		Duration: time.Second,
 	}
 
 	return c
 }
 
-func newTimer(key string) *timer {
+func newTimer(key string, start time.Time, interval time.Duration) *timer {
 
 	c := &timer{
 		baseSample: baseSample{
-			Key:  key,
-			lock: sync.Mutex{},
+			Key:      key,
+			Start:    start,
+			Interval: interval,
+			lock:     sync.Mutex{},
 		},
 	}
 
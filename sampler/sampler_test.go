@@ -1,16 +1,24 @@
 package sampler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/store"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestCounter(t *testing.T) {
 
-	c := newCounter("foo")
+	start := alignTime(time.Now(), time.Second)
+	c := newCounter("foo", start, time.Second)
 	assert.NotNil(t, c)
 	assert.NoError(t, c.Update(1, 1))
 	assert.NoError(t, c.Update(2, 0.1))
@@ -19,8 +27,8 @@ func TestCounter(t *testing.T) {
 	assert.Len(t, evs, 1)
 
 	assert.Equal(t, evs[0].Key, "foo")
-	assert.Equal(t, evs[0].Value, float32(21))
-	assert.Equal(t, evs[0].Time.Unix(), time.Now().Unix())
+	assert.Equal(t, evs[0].Value, float64(21))
+	assert.Equal(t, evs[0].Time, start)
 	fmt.Printf("%#v", c.Extract())
 }
 
@@ -33,7 +41,7 @@ func TestSampler(t *testing.T) {
 	assert.NoError(t, s.Sample("foo", 1, 0.5, SampleCounter))
 	assert.NoError(t, s.Sample("bar", 1, 0.2, SampleCounter))
 
-	events := s.flush()
+	events := extract(s.takeAll())
 	assert.True(t, len(events) == 2)
 	assert.True(t, len(s.samples) == 0)
 
@@ -46,3 +54,315 @@ func TestSampler(t *testing.T) {
 	fmt.Println(events)
 
 }
+
+type mockStore struct {
+	lock sync.Mutex
+	evs  []*events.Event
+	err  error
+	// failures is the number of Puts to fail before succeeding
+	failures int
+}
+
+func (m *mockStore) Put(evs ...*events.Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("flaky store")
+	}
+	m.evs = append(m.evs, evs...)
+	return nil
+}
+
+func (m *mockStore) Get(key string, from, to time.Time) (events.Result, error) {
+	return events.Result{Key: key}, nil
+}
+
+func (m *mockStore) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestStop(t *testing.T) {
+
+	st := &mockStore{}
+	s := NewSampler(time.Hour, st)
+	s.Run()
+
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	assert.NoError(t, s.Stop())
+	assert.Len(t, st.evs, 1)
+
+	assert.Equal(t, ErrStopped, s.Sample("foo", 1, 1, SampleCounter))
+	assert.NoError(t, s.Stop())
+}
+
+func TestSnapshot(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sampler.snapshot")
+
+	st := &mockStore{err: errors.New("store is down")}
+	s := NewSampler(time.Hour, st)
+	s.backoff = time.Millisecond
+	assert.NoError(t, s.EnableSnapshots(path))
+	s.Run()
+
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	assert.NoError(t, s.Sample("bar", 3, 1, SampleTimer))
+	assert.NoError(t, s.Stop())
+	assert.Len(t, st.evs, 0)
+
+	// the next run restores the snapshot into the store
+	st.err = nil
+	s = NewSampler(time.Hour, st)
+	assert.NoError(t, s.EnableSnapshots(path))
+	assert.Len(t, st.evs, 2)
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIntervals(t *testing.T) {
+
+	s := NewSampler(time.Second, nil)
+	assert.NoError(t, s.SetInterval("app.*", 10*time.Second))
+	assert.NoError(t, s.SetInterval("app.slow.", time.Minute))
+	assert.Error(t, s.SetInterval("sys.", 0))
+
+	assert.Equal(t, time.Second, s.intervalFor("sys.cpu"))
+	assert.Equal(t, 10*time.Second, s.intervalFor("app.requests"))
+	assert.Equal(t, time.Minute, s.intervalFor("app.slow.requests"))
+	assert.Equal(t, time.Second, s.resolution())
+
+	// samples are stamped with the start of their aligned interval
+	now := time.Unix(1436400003, 500)
+	_, err := s.get("app.requests", SampleCounter, now)
+	assert.NoError(t, err)
+	_, err = s.get("sys.cpu", SampleCounter, now)
+	assert.NoError(t, err)
+
+	evs := extract(s.takeDue(now.Add(time.Second)))
+	assert.Len(t, evs, 1)
+	assert.Equal(t, "sys.cpu", evs[0].Key)
+	assert.Equal(t, time.Unix(1436400003, 0), evs[0].Time)
+
+	// a sample in a new interval pushes the old one to be flushed
+	_, err = s.get("app.requests", SampleCounter, now.Add(10*time.Second))
+	assert.NoError(t, err)
+	evs = extract(s.takeDue(now.Add(10 * time.Second)))
+	assert.Len(t, evs, 1)
+	assert.Equal(t, time.Unix(1436400000, 0), evs[0].Time)
+
+	evs = extract(s.takeDue(now.Add(17 * time.Second)))
+	assert.Len(t, evs, 1)
+	assert.Equal(t, time.Unix(1436400010, 0), evs[0].Time)
+
+	intervals, err := ParseIntervals("app.*=10s, sys.=1s")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"app.*": 10 * time.Second, "sys.": time.Second}, intervals)
+	_, err = ParseIntervals("app.*")
+	assert.Error(t, err)
+}
+
+func TestBackpressure(t *testing.T) {
+
+	st := &mockStore{failures: 2}
+	s := NewSampler(time.Hour, st)
+	s.backoff = time.Millisecond
+	s.SetMaxKeys(2)
+	s.SetQueueSize(1)
+
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	assert.NoError(t, s.Sample("bar", 1, 1, SampleCounter))
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	assert.Equal(t, ErrTooManyKeys, s.Sample("baz", 1, 1, SampleCounter))
+
+	// the worker isn't running yet, so the second batch overflows the queue
+	s.enqueue(s.newBatch(s.takeAll()))
+	s.enqueue(batch{events: []*events.Event{events.NewEvent("foo", time.Now(), 1)}})
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, 1, stats.Queued)
+
+	s.Run()
+	assert.NoError(t, s.Stop())
+
+	stats = s.Stats()
+	assert.Len(t, st.evs, 2)
+	assert.Equal(t, uint64(2), stats.Flushed)
+	assert.Equal(t, uint64(4), stats.Retried)
+	assert.Equal(t, 0, stats.Queued)
+}
+
+// mockAggregator merges partials in memory, like the redis implementation does
+type mockAggregator struct {
+	lock     sync.Mutex
+	partials map[string]*store.Partial
+	leader   string
+}
+
+func (m *mockAggregator) Merge(partials ...store.Partial) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, p := range partials {
+		k := fmt.Sprintf("%s::%d", p.Key, p.Time.Unix())
+		if agg, found := m.partials[k]; found {
+			agg.Sum += p.Sum
+			agg.Count += p.Count
+		} else {
+			cp := p
+			m.partials[k] = &cp
+		}
+	}
+	return nil
+}
+
+func (m *mockAggregator) Finalize(before time.Time) ([]*events.Event, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var ret []*events.Event
+	for k, p := range m.partials {
+		if p.Time.Add(p.Interval).Before(before) {
+			val := p.Sum
+			if p.Average {
+				val /= p.Count
+			}
+			ret = append(ret, events.NewEvent(p.Key, p.Time, val))
+			delete(m.partials, k)
+		}
+	}
+	return ret, nil
+}
+
+func (m *mockAggregator) Lead(node string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.leader == "" {
+		m.leader = node
+	}
+	return m.leader == node, nil
+}
+
+func TestDistributed(t *testing.T) {
+
+	agg := &mockAggregator{partials: make(map[string]*store.Partial)}
+	st := &mockStore{}
+
+	nodes := []*Sampler{NewSampler(time.Second, st), NewSampler(time.Second, st)}
+	for i, s := range nodes {
+		s.EnableDistributed(agg, fmt.Sprintf("node%d", i), 0)
+		assert.NoError(t, s.Sample("foo", 2, 1, SampleCounter))
+		assert.NoError(t, s.Sample("bar", 10*float64(i+1), 1, SampleTimer))
+		assert.NoError(t, s.Stop())
+	}
+
+	// partials are merged, not written
+	assert.Len(t, st.evs, 0)
+	assert.Len(t, agg.partials, 2)
+
+	// only the leader finalizes
+	agg.leader = "node0"
+	nodes[1].finalize(time.Now().Add(time.Minute))
+	assert.Len(t, agg.partials, 2)
+	nodes[0].finalize(time.Now().Add(time.Minute))
+	assert.Len(t, agg.partials, 0)
+
+	if !assert.Len(t, nodes[0].queue, 1) {
+		return
+	}
+	b := <-nodes[0].queue
+	assert.Len(t, b.events, 2)
+	for _, ev := range b.events {
+		switch ev.Key {
+		case "foo":
+			assert.Equal(t, float64(4), ev.Value)
+		case "bar":
+			assert.Equal(t, float64(15), ev.Value)
+		default:
+			t.Error("Bad key", ev.Key)
+		}
+	}
+}
+
+type mockRegistry map[string]string
+
+func (m mockRegistry) RegisterType(key, typ string) (string, error) {
+	if t, found := m[key]; found {
+		return t, nil
+	}
+	m[key] = typ
+	return typ, nil
+}
+
+func (m mockRegistry) Types() (map[string]string, error) {
+	return m, nil
+}
+
+func TestTypes(t *testing.T) {
+
+	s := NewSampler(time.Second, nil)
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+
+	err := s.Sample("foo", 1, 1, SampleTimer)
+	assert.Equal(t, TypeConflictError{Key: "foo", Registered: "counter", Requested: SampleTimer}, err)
+	assert.Error(t, s.Sample("bar", 1, 1, SampleHistogram))
+
+	types, err := s.Types()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "counter"}, types)
+
+	// keys registered elsewhere are enforced too
+	reg := mockRegistry{"baz": "timer"}
+	s = NewSampler(time.Second, nil)
+	s.EnableTypeRegistry(reg)
+	assert.IsType(t, TypeConflictError{}, s.Sample("baz", 1, 1, SampleCounter))
+	assert.NoError(t, s.Sample("baz", 1, 1, SampleTimer))
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+
+	types, err = s.Types()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "counter", "baz": "timer"}, types)
+
+	// keys over the limit are rejected before they're registered
+	s.SetMaxKeys(2)
+	assert.Equal(t, ErrTooManyKeys, s.Sample("bar", 1, 1, SampleCounter))
+	assert.NotContains(t, reg, "bar")
+
+	// flushing makes room for new keys, while the types of the flushed ones stay cached
+	assert.Len(t, s.takeDue(time.Now().Add(time.Minute)), 2)
+	assert.Len(t, s.types, 2)
+	assert.NoError(t, s.Sample("bar", 1, 1, SampleCounter))
+	assert.Equal(t, "counter", reg["bar"])
+}
+
+func TestTypeExpiry(t *testing.T) {
+
+	s := NewSampler(time.Second, nil)
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+
+	// types outlive the samples of their keys, so they're still enforced in the next interval
+	now := time.Now()
+	assert.Len(t, s.takeDue(now.Add(time.Minute)), 1)
+	assert.IsType(t, TypeConflictError{}, s.Sample("foo", 1, 1, SampleTimer))
+	assert.Len(t, s.types, 1)
+
+	// a key with a pending sample doesn't expire
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleCounter))
+	s.lock.Lock()
+	s.expireTypes(now.Add(2 * typeExpiry))
+	s.lock.Unlock()
+	assert.Len(t, s.types, 1)
+
+	// once a key is idle for long enough, it expires and may come back as another type
+	assert.Len(t, s.takeDue(now.Add(2*typeExpiry)), 1)
+	assert.Empty(t, s.types)
+	assert.NoError(t, s.Sample("foo", 1, 1, SampleTimer))
+}
@@ -0,0 +1,60 @@
+package sampler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dvirsky/timedis/events"
+)
+
+// snapshotEntry is how an unflushed event is saved in a snapshot file
+type snapshotEntry struct {
+	Key   string  `json:"key"`
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
+
+// saveSnapshot writes events to path atomically, so a crash mid-write won't leave a corrupt snapshot
+func saveSnapshot(path string, evs []*events.Event) error {
+
+	entries := make([]snapshotEntry, 0, len(evs))
+	for _, ev := range evs {
+		entries = append(entries, snapshotEntry{Key: ev.Key, Time: ev.Time.UnixNano(), Value: ev.Value})
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadSnapshot reads the events saved at path. A missing snapshot is not an error
+func loadSnapshot(path string) ([]*events.Event, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []snapshotEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	ret := make([]*events.Event, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, events.NewEvent(e.Key, time.Unix(0, e.Time), e.Value))
+	}
+	return ret, nil
+}
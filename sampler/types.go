@@ -0,0 +1,122 @@
+package sampler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dvirsky/timedis/store"
+)
+
+// typeExpiry is how long a key's type stays cached after it was last sampled. Keys with a pending sample don't expire
+const typeExpiry = time.Hour
+
+// cachedType is the type name of a key, and when the key was last sampled
+type cachedType struct {
+	name    string
+	sampled time.Time
+}
+
+var sampleTypeNames = map[SampleType]string{
+	SampleCounter:   "counter",
+	SampleTimer:     "timer",
+	SampleHistogram: "histogram",
+}
+
+func (t SampleType) String() string {
+	if name, found := sampleTypeNames[t]; found {
+		return name
+	}
+	return fmt.Sprintf("SampleType(%d)", int(t))
+}
+
+// TypeConflictError is returned when sampling a key as a different type than it was registered with
+type TypeConflictError struct {
+	Key        string
+	Registered string
+	Requested  SampleType
+}
+
+func (e TypeConflictError) Error() string {
+	return fmt.Sprintf("Key %s is a %s, cannot sample it as a %s", e.Key, e.Registered, e.Requested)
+}
+
+// EnableTypeRegistry persists key types in r, so they are kept across restarts and shared between nodes.
+// It must be called before sampling
+func (s *Sampler) EnableTypeRegistry(r store.TypeRegistry) {
+	s.registry = r
+}
+
+// checkType makes sure key is sampled as the type it was first sampled as.
+// New keys are registered in the persistent registry if there is one. Types are cached until their keys expire
+func (s *Sampler) checkType(key string, t SampleType, now time.Time) error {
+
+	switch t {
+	case SampleCounter, SampleTimer:
+	default:
+		return fmt.Errorf("Unsupported sample type: %v", t)
+	}
+
+	// new keys are checked against the key limit before they're registered, so rejected keys aren't persisted
+	s.lock.Lock()
+	cached, found := s.types[key]
+	if !found && s.full(key) {
+		s.lock.Unlock()
+		atomic.AddUint64(&s.stats.rejected, 1)
+		return ErrTooManyKeys
+	}
+	if found {
+		cached.sampled = now
+		s.types[key] = cached
+	}
+	s.lock.Unlock()
+
+	registered := cached.name
+
+	if !found {
+		registered = t.String()
+		if s.registry != nil {
+			var err error
+			if registered, err = s.registry.RegisterType(key, registered); err != nil {
+				return err
+			}
+		}
+
+		s.lock.Lock()
+		s.types[key] = cachedType{name: registered, sampled: now}
+		s.lock.Unlock()
+	}
+
+	if registered != t.String() {
+		return TypeConflictError{Key: key, Registered: registered, Requested: t}
+	}
+	return nil
+}
+
+// Types returns the type of every key known to the sampler. If there is a persistent registry,
+// it includes keys sampled in previous runs or by other nodes, otherwise just the keys sampled recently
+func (s *Sampler) Types() (map[string]string, error) {
+
+	if s.registry != nil {
+		return s.registry.Types()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make(map[string]string, len(s.types))
+	for k, t := range s.types {
+		ret[k] = t.name
+	}
+	return ret, nil
+}
+
+// expireTypes evicts the cached types of keys that have no pending sample and weren't sampled for typeExpiry, so
+// they're checked against the registry again if they come back. It's called with the lock held
+func (s *Sampler) expireTypes(now time.Time) {
+	for key, t := range s.types {
+		if _, pending := s.samples[key]; !pending && now.Sub(t.sampled) > typeExpiry {
+			delete(s.types, key)
+		}
+	}
+}
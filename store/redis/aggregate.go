@@ -0,0 +1,168 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/events"
+	"github.com/dvirsky/timedis/store"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	aggPendingKey   = "agg::pending"
+	aggFinalizedKey = "agg::finalized"
+	aggLeaderKey    = "agg::leader"
+
+	// finalizedRetention is how long finalized intervals are remembered, rejecting partials that arrive late
+	finalizedRetention = 24 * time.Hour
+)
+
+// leadScript acquires the leader lock, or extends it if we already hold it
+var leadScript = redis.NewScript(1, `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// mergeScript adds partials to their aggregates, unless their interval was already finalized. ARGV holds 7 fields
+// per partial: the aggregate's hash key, the sampled key, time, sum, count, whether it's an average and the end time
+// of the interval. It returns the number of partials it rejected
+var mergeScript = redis.NewScript(2, `
+local rejected = 0
+for i = 1, #ARGV, 7 do
+	local k = ARGV[i]
+	if redis.call('ZSCORE', KEYS[2], k) then
+		rejected = rejected + 1
+	else
+		redis.call('HINCRBYFLOAT', k, 'sum', ARGV[i+3])
+		redis.call('HINCRBYFLOAT', k, 'count', ARGV[i+4])
+		redis.call('HMSET', k, 'key', ARGV[i+1], 'time', ARGV[i+2], 'avg', ARGV[i+5])
+		redis.call('ZADD', KEYS[1], ARGV[i+6], k)
+	end
+end
+return rejected
+`)
+
+// finalizeScript removes and returns the aggregates of the intervals that ended by ARGV[1], and records them as
+// finalized. Finalized intervals older than ARGV[2] are forgotten
+var finalizeScript = redis.NewScript(2, `
+local pending = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES')
+local ret = {}
+for i = 1, #pending, 2 do
+	local k = pending[i]
+	table.insert(ret, redis.call('HGETALL', k))
+	redis.call('DEL', k)
+	redis.call('ZREM', KEYS[1], k)
+	redis.call('ZADD', KEYS[2], pending[i+1], k)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+return ret
+`)
+
+func (s *Store) aggKey(p store.Partial) string {
+	return fmt.Sprintf("agg::%s::%s", encodeTime(p.Time), p.Key)
+}
+
+// Merge adds the partials to a hash per key and interval, and indexes the hash by the interval's end time.
+// Partials of intervals that were already finalized are dropped, so they can't be written twice
+func (s *Store) Merge(partials ...store.Partial) error {
+
+	if len(partials) == 0 {
+		return nil
+	}
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{aggPendingKey, aggFinalizedKey}
+	for _, p := range partials {
+		avg := 0
+		if p.Average {
+			avg = 1
+		}
+		args = args.Add(s.aggKey(p), p.Key, p.Time.UnixNano(), p.Sum, p.Count, avg, p.Time.Add(p.Interval).Unix())
+	}
+
+	rejected, err := redis.Int(mergeScript.Do(conn, args...))
+	if err != nil {
+		return err
+	}
+	if rejected > 0 {
+		logging.Warning("Dropped %d partials of intervals that were already finalized", rejected)
+	}
+	return nil
+}
+
+// Finalize computes the final value of every interval that ended before the given time, and removes its hash.
+// Reading and removing the hashes is atomic, so partials merged meanwhile are either included or rejected
+func (s *Store) Finalize(before time.Time) ([]*events.Event, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	aggs, err := redis.Values(finalizeScript.Do(conn, aggPendingKey, aggFinalizedKey, before.Unix(),
+		before.Add(-finalizedRetention).Unix()))
+	if err != nil || len(aggs) == 0 {
+		return nil, err
+	}
+
+	ret := make([]*events.Event, 0, len(aggs))
+	for _, a := range aggs {
+
+		var agg struct {
+			Key   string  `redis:"key"`
+			Time  int64   `redis:"time"`
+			Sum   float64 `redis:"sum"`
+			Count float64 `redis:"count"`
+			Avg   int     `redis:"avg"`
+		}
+
+		vals, err := redis.Values(a, nil)
+		if err == nil {
+			err = redis.ScanStruct(vals, &agg)
+		}
+		if err != nil {
+			logging.Error("Could not read aggregate: %s", err)
+			continue
+		}
+
+		if agg.Key != "" {
+			val := agg.Sum
+			if agg.Avg == 1 {
+				if agg.Count == 0 {
+					val = 0
+				} else {
+					val = agg.Sum / agg.Count
+				}
+			}
+			ret = append(ret, events.NewEvent(agg.Key, time.Unix(0, agg.Time), val))
+		}
+	}
+
+	return ret, nil
+}
+
+// Lead uses a redis key with a ttl as a leader lock
+func (s *Store) Lead(node string, ttl time.Duration) (bool, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	return redis.Bool(leadScript.Do(conn, aggLeaderKey, node, int64(ttl/time.Millisecond)))
+}
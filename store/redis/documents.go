@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func (s *Store) collectionKey(collection string) string {
+	return fmt.Sprintf("doc::%s", collection)
+}
+
+func (s *Store) logKey(log string) string {
+	return fmt.Sprintf("log::%s", log)
+}
+
+// SaveDocument stores documents as the fields of a hash per collection
+func (s *Store) SaveDocument(collection, id string, doc []byte) error {
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", s.collectionKey(collection), id, doc)
+	return err
+}
+
+func (s *Store) LoadDocuments(collection string) (map[string][]byte, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	vals, err := redis.ByteSlices(conn.Do("HGETALL", s.collectionKey(collection)))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]byte, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		ret[string(vals[i])] = vals[i+1]
+	}
+	return ret, nil
+}
+
+func (s *Store) DeleteDocument(collection, id string) error {
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HDEL", s.collectionKey(collection), id)
+	return err
+}
+
+// AppendLog pushes entries to the head of a list, trimming it to maxLen
+func (s *Store) AppendLog(log string, entry []byte, maxLen int) error {
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("LPUSH", s.logKey(log), entry)
+	conn.Send("LTRIM", s.logKey(log), 0, maxLen-1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *Store) ReadLog(log string, n int) ([][]byte, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.ByteSlices(conn.Do("LRANGE", s.logKey(log), 0, n-1))
+}
@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// scanCount is the number of keys we ask redis to look at per SCAN call
+const scanCount = 1000
+
+// Keys scans the data keys matching the pattern. SCAN doesn't block redis like KEYS does, but may return a key more
+// than once, so results are deduplicated
+func (s *Store) Keys(pattern string) ([]string, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	prefix := s.dataKey("")
+	found := make(map[string]bool)
+	cursor := 0
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.dataKey(pattern), "COUNT", scanCount))
+		if err != nil {
+			return nil, err
+		}
+		if cursor, err = redis.Int(vals[0], nil); err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			found[strings.TrimPrefix(k, prefix)] = true
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	ret := make([]string, 0, len(found))
+	for k := range found {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
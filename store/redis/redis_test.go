@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -72,7 +73,7 @@ func TestSubscribe(t *testing.T) {
 	store := NewStore("localhost:6379")
 	k := "foo.pbsb"
 
-	sub, err := store.Subscribe(k)
+	sub, err := store.Subscribe(context.Background(), k)
 	assert.NoError(t, err)
 	var res events.Result
 	wg := sync.WaitGroup{}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -77,6 +78,26 @@ func (s *Store) pubsubKey(key string) string {
 	return fmt.Sprintf("ps::%s", key)
 }
 
+// Last relies on records sorting by their time, as all of them are added with the same score
+func (s *Store) Last(key string) (events.Record, bool, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return events.Record{}, false, err
+	}
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("ZREVRANGEBYLEX", s.dataKey(key), "+", "-", "LIMIT", 0, 1))
+	if err != nil || len(values) == 0 {
+		return events.Record{}, false, err
+	}
+
+	rec, err := decodeRecord(values[0])
+	if err != nil {
+		return events.Record{}, false, err
+	}
+	return rec, true, nil
+}
+
 func (s *Store) Get(key string, from, to time.Time) (events.Result, error) {
 	conn, err := s.conn()
 	if err != nil {
@@ -125,7 +146,9 @@ func (s *Store) pushUpdate(key, encodedRecord string) {
 	}
 
 }
-func (s *Store) Subscribe(key string) (<-chan events.Result, error) {
+
+// Subscribe streams the records published to a key until ctx is canceled, reconnecting if the connection breaks
+func (s *Store) Subscribe(ctx context.Context, key string) (<-chan events.Result, error) {
 
 	conn, err := s.conn()
 	if err != nil {
@@ -135,54 +158,34 @@ func (s *Store) Subscribe(key string) (<-chan events.Result, error) {
 	ch := make(chan events.Result)
 
 	go func() {
-		for {
+		defer close(ch)
 
+		for {
 			if conn == nil {
 				if conn, err = s.conn(); err != nil {
 					logging.Error("Error connecting to pubsub: %s", err)
 				}
-			} else {
+			}
 
-				psc := redis.PubSubConn{conn}
-				err := psc.Subscribe(s.pubsubKey(key))
-				if err != nil {
-					logging.Error("Could not subscribe: %s", err)
-					time.Sleep(100 * time.Microsecond)
-					conn.Close()
-					conn = nil
-					continue
+			// the connection is only ever closed here, once receive is done with it
+			if conn != nil {
+				if err := s.receive(ctx, conn, key, ch); err != nil {
+					logging.Error("Error reading pubsub: %s", err)
 				}
+				conn.Close()
+				conn = nil
+			}
 
-				for err == nil {
-					switch v := psc.Receive().(type) {
-					case redis.Message:
-						logging.Info("Got an update for %s: %s", key, string(v.Data))
-
-						if rec, err := decodeRecord(string(v.Data)); err != nil {
-							logging.Warning("Could not decode pubsub message! %s", err)
-							continue
-						} else {
-							ch <- events.Result{
-								Key:     key,
-								Records: []events.Record{rec},
-							}
-						}
-
-					case redis.Subscription:
-						logging.Debug("Subscription %s: %s %d\n", v.Channel, v.Kind, v.Count)
-					case error:
-						logging.Error("Error reading pubsub: %s", v)
-						conn.Close()
-						conn = nil
-						err = v
-						break
-					}
-
-				}
+			if ctx.Err() != nil {
+				return
 			}
 
 			// sleep before retrying
-			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
 		}
 
 	}()
@@ -190,3 +193,61 @@ func (s *Store) Subscribe(key string) (<-chan events.Result, error) {
 	return ch, nil
 
 }
+
+// receive subscribes to a key on conn and sends its records to ch, until the connection fails or ctx is canceled
+func (s *Store) receive(ctx context.Context, conn redis.Conn, key string, ch chan<- events.Result) error {
+
+	psc := redis.PubSubConn{conn}
+	if err := psc.Subscribe(s.pubsubKey(key)); err != nil {
+		return err
+	}
+
+	// Receive blocks on the connection, so once ctx is canceled we unsubscribe, and return on the confirmation. We
+	// wait for the unsubscribing goroutine before returning, so it never writes to a connection being closed
+	done := make(chan struct{})
+	unsubscribed := make(chan struct{})
+	defer func() {
+		close(done)
+		<-unsubscribed
+	}()
+	go func() {
+		defer close(unsubscribed)
+		select {
+		case <-ctx.Done():
+			if err := psc.Unsubscribe(); err != nil {
+				logging.Warning("Could not unsubscribe from %s: %s", key, err)
+			}
+		case <-done:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			logging.Debug("Got an update for %s: %s", key, string(v.Data))
+
+			rec, err := decodeRecord(string(v.Data))
+			if err != nil {
+				logging.Warning("Could not decode pubsub message! %s", err)
+				continue
+			}
+
+			// once canceled, messages are dropped until the unsubscription is confirmed
+			select {
+			case ch <- events.Result{Key: key, Records: []events.Record{rec}}:
+			case <-ctx.Done():
+			}
+
+		case redis.Subscription:
+			logging.Debug("Subscription %s: %s %d\n", v.Channel, v.Kind, v.Count)
+			if v.Kind == "unsubscribe" && v.Count == 0 {
+				return nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package redis
+
+import "github.com/garyburd/redigo/redis"
+
+const typesKey = "meta::types"
+
+// RegisterType sets the key's type in a hash of all key types, unless it's already there
+func (s *Store) RegisterType(key, typ string) (string, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSETNX", typesKey, key, typ)
+	conn.Send("HGET", typesKey, key)
+	vals, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+
+	return redis.String(vals[1], nil)
+}
+
+func (s *Store) Types() (map[string]string, error) {
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.StringMap(conn.Do("HGETALL", typesKey))
+}
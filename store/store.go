@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"time"
 
 	"github.com/dvirsky/timedis/events"
@@ -9,5 +10,60 @@ import (
 type Store interface {
 	Put(...*events.Event) error
 	Get(key string, from, to time.Time) (events.Result, error)
-	Subscribe(key string) (<-chan events.Result, error)
+	// Subscribe streams new records of a key. The channel is closed once ctx is canceled
+	Subscribe(ctx context.Context, key string) (<-chan events.Result, error)
+}
+
+// Partial is one node's partial aggregate of a sampled key over an interval
+type Partial struct {
+	Key      string
+	Time     time.Time
+	Interval time.Duration
+	Sum      float64
+	Count    float64
+	// Average means the final value is Sum/Count (timers), otherwise it's just Sum (counters)
+	Average bool
+}
+
+// Aggregator merges partial aggregates from several nodes, so that sampled keys are correct
+// when multiple timedis instances sample the same keys
+type Aggregator interface {
+	// Merge adds partials to the shared aggregates of their intervals
+	Merge(...Partial) error
+	// Finalize removes and returns the events of all intervals that ended before the given time
+	Finalize(before time.Time) ([]*events.Event, error)
+	// Lead tries to acquire or extend leadership for node for ttl. Only the leader should finalize intervals
+	Lead(node string, ttl time.Duration) (bool, error)
+}
+
+// TypeRegistry persists the sample type of each sampled key, so a key can't be sampled as different types
+type TypeRegistry interface {
+	// RegisterType sets the key's type if it has none, and returns the key's registered type
+	RegisterType(key, typ string) (string, error)
+	// Types returns the registered types of all keys
+	Types() (map[string]string, error)
+}
+
+// Documents persists server side state, such as alert rules, as opaque documents in named collections
+type Documents interface {
+	SaveDocument(collection, id string, doc []byte) error
+	LoadDocuments(collection string) (map[string][]byte, error)
+	DeleteDocument(collection, id string) error
+	// AppendLog adds an entry to a capped log, keeping only its last maxLen entries
+	AppendLog(log string, entry []byte, maxLen int) error
+	// ReadLog returns the last n entries of a log, newest first
+	ReadLog(log string, n int) ([][]byte, error)
+}
+
+// LastReader reads the newest record of a key, without getting its whole range
+type LastReader interface {
+	// Last returns the newest record of a key, and false if it has none
+	Last(key string) (events.Record, bool, error)
+}
+
+// KeyLister lists the stored keys
+type KeyLister interface {
+	// Keys returns the sorted keys matching a glob pattern, where * matches any sequence of characters and ? any
+	// single character
+	Keys(pattern string) ([]string, error)
 }
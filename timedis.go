@@ -1,41 +1,156 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/EverythingMe/vertex"
 	"github.com/dvirsky/go-pylog/logging"
+	"github.com/dvirsky/timedis/alert"
+	"github.com/dvirsky/timedis/jobs"
 	"github.com/dvirsky/timedis/pipeline"
 	"github.com/dvirsky/timedis/sampler"
 	"github.com/dvirsky/timedis/store"
 	"github.com/dvirsky/timedis/store/redis"
 )
 
+// shutdownTimeout is how long we wait for in-flight requests to finish when shutting down
+const shutdownTimeout = 10 * time.Second
+
+var (
+	snapshotPath    = flag.String("snapshot", "", "If set, sampler data that could not be flushed on shutdown is saved to this file and restored on startup")
+	sampleIntervals = flag.String("intervals", "", "Per prefix sampler flush intervals, e.g. app.*=10s,sys.*=1s. Other keys are flushed every second")
+	maxSampleKeys   = flag.Int("max_keys", 0, "Maximum number of distinct keys the sampler aggregates per interval. 0 means no limit")
+	flushQueueSize  = flag.Int("flush_queue", sampler.DefaultQueueSize, "Number of flushed sampler batches that can wait for redis before we start dropping them")
+	distributed     = flag.Bool("distributed", false, "Merge sampler aggregates with other timedis nodes sharing the same redis, instead of writing them directly")
+	nodeName        = flag.String("node", "", "This node's name for distributed sampling. Defaults to the hostname")
+	sinksPath       = flag.String("sinks", "", "A json file of the notification sinks queries and alerts may notify by name, e.g. {\"ops\": {\"type\": \"webhook\", \"params\": {\"url\": \"...\"}}}")
+	mergeGrace      = flag.Duration("merge_grace", 5*time.Second, "How long after an interval ends the distributed sampler waits for other nodes' partials before finalizing it")
+)
+
 type Engine struct {
 	Sampler *sampler.Sampler
 	Store   store.Store
+	Alerts  *alert.Manager
+	Jobs    *jobs.Manager
+	// Hub shares identical live subtrees and the store subscriptions of faucets between subscriptions
+	Hub *pipeline.Hub
 }
 
 func main() {
 
+	vertex.ReadConfigs()
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	logging.SetMinimalLevelByName(vertex.Config.Server.LoggingLevel)
+
+	intervals, err := sampler.ParseIntervals(*sampleIntervals)
+	if err != nil {
+		panic(err)
+	}
+
 	store := redis.NewStore("localhost:6379")
 	sampler := sampler.NewSampler(time.Second, store)
+	for prefix, interval := range intervals {
+		if err := sampler.SetInterval(prefix, interval); err != nil {
+			panic(err)
+		}
+	}
+	sampler.EnableTypeRegistry(store)
+	sampler.SetMaxKeys(*maxSampleKeys)
+	sampler.SetQueueSize(*flushQueueSize)
+	if *distributed {
+		node := *nodeName
+		if node == "" {
+			if node, err = os.Hostname(); err != nil {
+				panic(err)
+			}
+		}
+		sampler.EnableDistributed(store, node, *mergeGrace)
+	}
+	if *snapshotPath != "" {
+		if err := sampler.EnableSnapshots(*snapshotPath); err != nil {
+			logging.Error("Could not restore sampler snapshot: %s", err)
+		}
+	}
 
 	pipeline.InitStore(store)
+	if *sinksPath != "" {
+		if err := loadSinks(*sinksPath); err != nil {
+			panic(err)
+		}
+	}
+	alerts := alert.NewManager(store)
+	if err := alerts.Load(); err != nil {
+		logging.Error("Could not load alert rules: %s", err)
+	}
+	jobs := jobs.NewManager(store)
+	if err := jobs.Load(); err != nil {
+		logging.Error("Could not load jobs: %s", err)
+	}
 	engine = &Engine{
 		Store:   store,
 		Sampler: sampler,
+		Alerts:  alerts,
+		Jobs:    jobs,
+		Hub:     pipeline.NewHub(),
 	}
 
 	sampler.Run()
 
-	vertex.ReadConfigs()
-
-	logging.SetMinimalLevelByName(vertex.Config.Server.LoggingLevel)
 	srv := vertex.NewServer(vertex.Config.Server.ListenAddr)
 	srv.InitAPIs()
-	if err := srv.Run(); err != nil {
-		panic(err)
+
+	httpServer := &http.Server{
+		Addr:    vertex.Config.Server.ListenAddr,
+		Handler: srv.Handler(),
+	}
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigch
+	logging.Info("Got %s, shutting down", sig)
+
+	// stop accepting requests and drain the in-flight ones, so their samples make it into the final flush
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logging.Warning("Not all requests finished before shutdown: %s", err)
 	}
 
+	alerts.Stop()
+	jobs.Stop()
+	if err := sampler.Stop(); err != nil {
+		logging.Error("Error stopping sampler: %s", err)
+	}
+
+}
+
+// loadSinks configures the notification sinks from a json file mapping their names to their configs
+func loadSinks(path string) error {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var sinks map[string]pipeline.SinkConfig
+	if err := json.Unmarshal(b, &sinks); err != nil {
+		return err
+	}
+	return pipeline.ConfigureSinks(sinks)
 }